@@ -1,12 +1,16 @@
 package api
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 type NotFoundError struct {
@@ -25,10 +29,47 @@ func IsNotFound(err error) bool {
 	return ok
 }
 
+// Reports if err is caused by unique or primary key constraint
+func IsUniqueViolation(err error) bool {
+	sqlErr, ok := err.(sqlite3.Error)
+	if !ok {
+		return false
+	}
+	return sqlErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqlErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
+
+// DBWorker settings
+type DBConfig struct {
+	// How long a connection waits for a lock held by another one
+	BusyTimeout time.Duration
+	// Size of read connections pool
+	MaxReaders int
+	// Limit for a single query or transaction, zero means no limit
+	QueryTimeout time.Duration
+}
+
+var DefaultDBConfig = DBConfig{
+	BusyTimeout:  5 * time.Second,
+	MaxReaders:   2 * runtime.NumCPU(),
+	QueryTimeout: 10 * time.Second,
+}
+
+// Database in WAL mode accessed through single write connection
+// and a pool of read-only connections which do not wait for writes.
 type DBWorker struct {
 	Path string
-	DB   *sqlx.DB
-	mu   sync.Mutex
+	// Connection for mutations, writes are serialized by mu
+	DB *sqlx.DB
+	// Read-only pool
+	RDB          *sqlx.DB
+	mu           sync.Mutex
+	maxReaders   int
+	queryTimeout time.Duration
+	// Image paths jobs in progress are going to save and paths whose files
+	// are being removed with channels closed once they are, guarded by mu
+	pinned   map[string]int
+	removing map[string]chan struct{}
 }
 
 type SQL struct {
@@ -41,41 +82,101 @@ func sqlStmt(query string, args ...interface{}) *SQL {
 }
 
 func NewDBWorker(path string) (*DBWorker, error) {
-	db, err := sqlx.Open("sqlite3", path)
+	return NewDBWorkerConfig(path, DefaultDBConfig)
+}
+
+func NewDBWorkerConfig(path string, cfg DBConfig) (*DBWorker, error) {
+	busy := cfg.BusyTimeout.Milliseconds()
+	db, err := sqlx.Open("sqlite3", fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate", path, busy))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	// Switches file to WAL before any reader connects
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	rdb, err := sqlx.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d&_query_only=1", path, busy))
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	return &DBWorker{Path: path, DB: db}, nil
+	if cfg.MaxReaders > 0 {
+		rdb.SetMaxOpenConns(cfg.MaxReaders)
+		rdb.SetMaxIdleConns(cfg.MaxReaders)
+	}
+	return &DBWorker{
+		Path:         path,
+		DB:           db,
+		RDB:          rdb,
+		maxReaders:   cfg.MaxReaders,
+		queryTimeout: cfg.QueryTimeout,
+		pinned:       make(map[string]int),
+		removing:     make(map[string]chan struct{}),
+	}, nil
+}
+
+// Closes idle read connections, they keep schema loaded on their first use
+// and would prepare "select *" with stale columns list after schema change.
+func (dbw *DBWorker) resetReaders() {
+	dbw.RDB.SetMaxIdleConns(-1)
+	if dbw.maxReaders > 0 {
+		dbw.RDB.SetMaxIdleConns(dbw.maxReaders)
+	} else {
+		dbw.RDB.SetMaxIdleConns(2)
+	}
+}
+
+// Limits ctx with the query timeout of the worker
+func (dbw *DBWorker) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if dbw.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, dbw.queryTimeout)
 }
 
 func (dbw *DBWorker) QueryRow(query string, args ...interface{}) *sql.Row {
-	dbw.mu.Lock()
-	defer dbw.mu.Unlock()
-	return dbw.DB.QueryRow(query, args...)
+	return dbw.QueryRowContext(context.Background(), query, args...)
+}
+
+// Query timeout is not applied here since the row is scanned after return,
+// ctx is the only way to cancel the query.
+func (dbw *DBWorker) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return dbw.RDB.QueryRowContext(ctx, query, args...)
 }
 
 func (dbw *DBWorker) Select(dest interface{}, query string, args ...interface{}) error {
-	dbw.mu.Lock()
-	defer dbw.mu.Unlock()
-	return dbw.DB.Select(dest, query, args...)
+	return dbw.SelectContext(context.Background(), dest, query, args...)
+}
+
+func (dbw *DBWorker) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, cancel := dbw.queryContext(ctx)
+	defer cancel()
+	return dbw.RDB.SelectContext(ctx, dest, query, args...)
 }
 
 func (dbw *DBWorker) WriteOne(query string, args ...interface{}) error {
+	return dbw.WriteOneContext(context.Background(), query, args...)
+}
+
+func (dbw *DBWorker) WriteOneContext(ctx context.Context, query string, args ...interface{}) error {
+	ctx, cancel := dbw.queryContext(ctx)
+	defer cancel()
 	dbw.mu.Lock()
 	defer dbw.mu.Unlock()
-	stmt, err := dbw.DB.Prepare(query)
-	if err != nil {
-		return err
-	}
-	_, err = stmt.Exec(args...)
+	_, err := dbw.DB.ExecContext(ctx, query, args...)
 	return err
-
 }
 
 func (dbw *DBWorker) Get(dest interface{}, query string, args ...interface{}) error {
-	dbw.mu.Lock()
-	defer dbw.mu.Unlock()
-	err := dbw.DB.Get(dest, query, args...)
+	return dbw.GetContext(context.Background(), dest, query, args...)
+}
+
+func (dbw *DBWorker) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, cancel := dbw.queryContext(ctx)
+	defer cancel()
+	err := dbw.RDB.GetContext(ctx, dest, query, args...)
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows") {
 			return NotFoundError{}
@@ -86,38 +187,43 @@ func (dbw *DBWorker) Get(dest interface{}, query string, args ...interface{}) er
 
 // Writes to database inside transaction
 func (dbw *DBWorker) Write(sqls ...*SQL) error {
+	return dbw.WriteContext(context.Background(), sqls...)
+}
+
+func (dbw *DBWorker) WriteContext(ctx context.Context, sqls ...*SQL) error {
 	if len(sqls) == 1 {
-		return dbw.WriteOne(sqls[0].Q, sqls[0].Args...)
-	} else {
-		dbw.mu.Lock()
-		defer dbw.mu.Unlock()
-		tx, err := dbw.DB.Begin()
-		if err != nil {
+		return dbw.WriteOneContext(ctx, sqls[0].Q, sqls[0].Args...)
+	}
+	ctx, cancel := dbw.queryContext(ctx)
+	defer cancel()
+	dbw.mu.Lock()
+	defer dbw.mu.Unlock()
+	tx, err := dbw.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, mutation := range sqls {
+		if _, err := tx.ExecContext(ctx, mutation.Q, mutation.Args...); err != nil {
 			return err
 		}
-		defer tx.Rollback()
-		for _, mutation := range sqls {
-			stmt, err := tx.Prepare(mutation.Q)
-			if err != nil {
-				return err
-			}
-			_, err = stmt.Exec(mutation.Args...)
-			stmt.Close()
-			if err != nil {
-				return err
-			}
-		}
-		tx.Commit()
 	}
-	return nil
+	return tx.Commit()
 }
 
 func (dbw *DBWorker) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	return dbw.NamedExecContext(context.Background(), query, arg)
+}
+
+func (dbw *DBWorker) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	ctx, cancel := dbw.queryContext(ctx)
+	defer cancel()
 	dbw.mu.Lock()
 	defer dbw.mu.Unlock()
-	return dbw.DB.NamedExec(query, arg)
+	return dbw.DB.NamedExecContext(ctx, query, arg)
 }
 
 func (dbw *DBWorker) Close() {
+	dbw.RDB.Close()
 	dbw.DB.Close()
 }
@@ -1,11 +1,13 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,10 +18,12 @@ func testDBWorker() (*DBWorker, error) {
 	return NewDBWorker(tmpFile.Name())
 }
 
-// Closes DBWorker and unlinks its file
+// Closes DBWorker and unlinks its files
 func removeWorker(dbw *DBWorker) {
 	dbw.Close()
 	os.Remove(dbw.Path)
+	os.Remove(dbw.Path + "-wal")
+	os.Remove(dbw.Path + "-shm")
 }
 
 func TestNewDBWorker(t *testing.T) {
@@ -44,20 +48,42 @@ func TestDBWriteRead(t *testing.T) {
 	assert.Equal(t, name, "bar")
 }
 
+func TestWALMode(t *testing.T) {
+	dbw, err := testDBWorker()
+	if assert.Nil(t, err) {
+		defer removeWorker(dbw)
+	}
+	var mode string
+	assert.Nil(t, dbw.QueryRow("pragma journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+	assert.Nil(t, dbw.Write(sqlStmt("create table foo(id int, name text)")))
+	// read pool must not accept mutations
+	_, err = dbw.RDB.Exec("insert into foo values (1, 'foo')")
+	assert.NotNil(t, err)
+}
+
 func TestMutithreadWrite(t *testing.T) {
 	var wg sync.WaitGroup
 	dbw, err := testDBWorker()
 	assert.Nil(t, err)
 	assert.Nil(t, dbw.Write(sqlStmt("create table foo(id int, name text)")))
 	for i := 0; i < 1000; i++ {
-		wg.Add(1)
+		wg.Add(2)
 		go func(i int) {
-			err = dbw.Write(sqlStmt("insert into foo values (?, ?)", i, fmt.Sprintf("name%d", i)))
+			err := dbw.Write(sqlStmt("insert into foo values (?, ?)", i, fmt.Sprintf("name%d", i)))
 			assert.Nil(t, err)
 			wg.Done()
 		}(i)
+		go func() {
+			var count int
+			assert.Nil(t, dbw.Get(&count, "select count(*) from foo"))
+			wg.Done()
+		}()
 	}
 	wg.Wait()
+	var count int
+	assert.Nil(t, dbw.Get(&count, "select count(*) from foo"))
+	assert.Equal(t, 1000, count)
 	var name string
 	err = dbw.QueryRow("select name from foo where id = ?", 1).Scan(&name)
 	assert.Nil(t, err)
@@ -67,3 +93,66 @@ func TestMutithreadWrite(t *testing.T) {
 		println(dbw.Path)
 	}
 }
+
+func TestContextCancel(t *testing.T) {
+	tmpFile, _ := ioutil.TempFile("", "db")
+	cfg := DefaultDBConfig
+	cfg.QueryTimeout = 50 * time.Millisecond
+	dbw, err := NewDBWorkerConfig(tmpFile.Name(), cfg)
+	if assert.Nil(t, err) {
+		defer removeWorker(dbw)
+	}
+	assert.Nil(t, dbw.Write(sqlStmt("create table foo(id int, name text)")))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var count int
+	assert.Equal(t, context.Canceled, dbw.GetContext(ctx, &count, "select count(*) from foo"))
+	assert.NotNil(t, dbw.WriteContext(ctx, sqlStmt("insert into foo values (?, ?)", 1, "foo")))
+	// endless query is interrupted by the query timeout
+	slow := `with recursive r(i) as (select 1 union all select i+1 from r) select count(*) from r`
+	start := time.Now()
+	assert.NotNil(t, dbw.GetContext(context.Background(), &count, slow))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+// Measures reads throughput while another goroutine keeps writing
+func BenchmarkReadUnderWrite(b *testing.B) {
+	dbw, err := testDBWorker()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer removeWorker(dbw)
+	if err := dbw.Write(sqlStmt("create table foo(id int primary key, name text)")); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		dbw.Write(sqlStmt("insert into foo values (?, ?)", i, fmt.Sprintf("name%d", i)))
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1000; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			dbw.Write(sqlStmt("insert into foo values (?, ?)", i, fmt.Sprintf("name%d", i)))
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var name string
+		i := 0
+		for pb.Next() {
+			if err := dbw.Get(&name, "select name from foo where id = ?", i%1000); err != nil {
+				b.Error(err)
+			}
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
@@ -1,11 +1,15 @@
 package api
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"mime/multipart"
-	"path/filepath"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -13,7 +17,22 @@ type User struct {
 	ID       string
 	Username string
 	Password string
-	Token    string
+}
+
+// Token authorizing requests of a user until it expires or is revoked
+type AuthToken struct {
+	ID     string
+	UserID string `db:"user_id"`
+	// Leading characters of the token to find it
+	Prefix string
+	// Keyed hash of the whole token
+	Hash string
+	// Token itself, known only when it is issued
+	Key        string       `db:"-"`
+	CreatedAt  time.Time    `db:"created_at"`
+	ExpiresAt  sql.NullTime `db:"expires_at"`
+	LastUsedAt sql.NullTime `db:"last_used_at"`
+	RevokedAt  sql.NullTime `db:"revoked_at"`
 }
 
 const (
@@ -27,13 +46,13 @@ const (
 	JOB_SQUARE_ORIG  = "square_original"
 	JOB_SQUARE_SMALL = "square_small"
 	JOB_ALL_THREE    = "all_three"
+	JOB_RESIZE       = "resize"
 )
 
-var JobKind = map[string]bool{
-	JOB_ORIG:         true,
-	JOB_SQUARE_ORIG:  true,
-	JOB_SQUARE_SMALL: true,
-	JOB_ALL_THREE:    true,
+var JobStateNames = map[int64]string{
+	JobStateStarted: "started",
+	JobStateFailed:  "failed",
+	JobStateDone:    "done",
 }
 
 type Job struct {
@@ -41,100 +60,131 @@ type Job struct {
 	UserID string `db:"user_id"`
 	State  int64
 	Kind   string
+	// Reason of the failure when State is JobStateFailed
+	Error      string
+	CreatedAt  time.Time    `db:"created_at"`
+	StartedAt  sql.NullTime `db:"started_at"`
+	FinishedAt sql.NullTime `db:"finished_at"`
+	// Parameters passed to the processor of job kind
+	Params JobParams
+	// Batch the job was submitted in, empty for single jobs
+	BatchID string `db:"batch_id"`
+	// Server instance which staged upload of the job and performs it
+	Instance string
+}
+
+// Processor parameters stored as JSON object
+type JobParams map[string]string
+
+func (p JobParams) Value() (driver.Value, error) {
+	if p == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(p)
+	return string(data), err
+}
+
+func (p *JobParams) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*p = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("Could not scan %T into JobParams.", src)
+	}
+	return json.Unmarshal(data, p)
+}
+
+// Single-use code allowing to sign up
+type InviteCode struct {
+	Code      string
+	CreatedAt time.Time      `db:"created_at"`
+	UsedBy    sql.NullString `db:"used_by"`
+	UsedAt    sql.NullTime   `db:"used_at"`
 }
 
 type Image struct {
-	ID       string
-	UserID   string `db:"user_id"`
-	JobID    string `db:"job_id"`
+	ID     string
+	UserID string `db:"user_id"`
+	JobID  string `db:"job_id"`
+	// Processor which produced the image
+	Kind     string
 	MimeType string `db:"mime_type"`
 	Path     string
 	Size     int64
 	Width    int
 	Height   int
+	// Hex encoded SHA-256 of the stored content, images with the same
+	// content share the path
+	Digest string
+	// Digest of the upload the image was made from
+	SourceDigest string `db:"source_digest"`
 }
 
-func (dbw *DBWorker) CreateUserTable() error {
-	schema := `create table users (
-				id text primary key, 
-				username text unique not null, 
-				password text not null, 
-				token text unique not null)`
-	return dbw.WriteOne(schema)
-}
-
-func (dbw *DBWorker) CreateJobTable() error {
-	schema := `create table jobs (
-			id text primary key,
-			user_id text not null,
-			state int not null,
-			kind text not null,
-			foreign key (user_id) 
-				references users (id)
-				)`
-	return dbw.WriteOne(schema)
-}
-
-func (dbw *DBWorker) CreateImageTable() error {
-	schema := `create table images (
-			id text primary key,
-			user_id text not null,
-			job_id text not null,
-			path text unique not null,
-			mime_type text not null,
-			size int not null,
-			width int not null,
-			height int not null,
-			foreign key (user_id)
-				references users (id),
-			foreign key (job_id)
-				references jobs (id)
-			)`
-	return dbw.WriteOne(schema)
+// Brings database schema up to date
+func (dbw *DBWorker) CreateTables() error {
+	_, err := dbw.Migrate()
+	return err
 }
 
-func (dbw *DBWorker) CreateTables() error {
-	if err := dbw.CreateUserTable(); err != nil {
+func (dbw *DBWorker) SaveNewUser(ctx context.Context, user *User) error {
+	return dbw.WriteOneContext(ctx, "insert into users (id, username, password) values (?,?,?)",
+		user.ID, user.Username, user.Password)
+}
+
+// Saves new user and marks invite code as used by it in one transaction.
+// Returns NotFoundError if code does not exist or was already used.
+func (dbw *DBWorker) SaveNewUserWithInvite(ctx context.Context, user *User, code string) error {
+	dbw.mu.Lock()
+	defer dbw.mu.Unlock()
+	ctx, cancel := dbw.queryContext(ctx)
+	defer cancel()
+	tx, err := dbw.DB.BeginTx(ctx, nil)
+	if err != nil {
 		return err
 	}
-	if err := dbw.CreateJobTable(); err != nil {
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "update invite_codes set used_by=?, used_at=? where code=? and used_by is null",
+		user.ID, time.Now().UTC(), code)
+	if err != nil {
 		return err
 	}
-	if err := dbw.CreateImageTable(); err != nil {
+	n, err := res.RowsAffected()
+	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (dbw *DBWorker) SaveNewUser(user *User) error {
-	return dbw.WriteOne("insert into users (id, username, password, token) values (?,?,?,?)",
-		user.ID, user.Username, user.Password, user.Token)
+	if n != 1 {
+		return NotFoundError{Msg: "InviteCodeNotFound"}
+	}
+	_, err = tx.ExecContext(ctx, "insert into users (id, username, password) values (?,?,?)",
+		user.ID, user.Username, user.Password)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (dbw *DBWorker) SaveUser(user *User) error {
-	_, err := dbw.NamedExec(`update users 
-                            set username=:username, password=:password, token=:token
+func (dbw *DBWorker) SaveUser(ctx context.Context, user *User) error {
+	_, err := dbw.NamedExecContext(ctx, `update users 
+                            set username=:username, password=:password
 							where id=:id`, user)
 	return err
 }
 
-func (dbw *DBWorker) LoadUser(user *User, id string) error {
-	return dbw.Get(user, "select * from users where id=?", id)
+func (dbw *DBWorker) LoadUser(ctx context.Context, user *User, id string) error {
+	return dbw.GetContext(ctx, user, "select * from users where id=?", id)
 }
 
-func (dbw *DBWorker) LoadUserByName(user *User, username string) error {
-	return dbw.Get(user, "select * from users where username=?", username)
-}
-
-func (dbw *DBWorker) LoadUserByToken(user *User, token string) error {
-	return dbw.Get(user, "select * from users where token=?", token)
+func (dbw *DBWorker) LoadUserByName(ctx context.Context, user *User, username string) error {
+	return dbw.GetContext(ctx, user, "select * from users where username=?", username)
 }
 
 func NewUser(username, password string) (*User, error) {
-	token, err := NewToken()
-	if err != nil {
-		return nil, err
-	}
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
 	if err != nil {
 		return nil, err
@@ -143,7 +193,7 @@ func NewUser(username, password string) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
-	user := &User{ID: id, Username: username, Password: string(hash), Token: token}
+	user := &User{ID: id, Username: username, Password: string(hash)}
 	return user, nil
 }
 
@@ -158,8 +208,124 @@ func (u *User) IsPasswdValid(passwd string) bool {
 	return true
 }
 
+// Returns token of the user valid for ttl, zero ttl means it never expires.
+// Only hash of the token made with secret gets stored.
+func NewAuthToken(userID string, ttl time.Duration, secret []byte) (*AuthToken, error) {
+	key, err := NewToken()
+	if err != nil {
+		return nil, err
+	}
+	id, err := NewULIDNow()
+	if err != nil {
+		return nil, err
+	}
+	t := &AuthToken{
+		ID:        id,
+		UserID:    userID,
+		Prefix:    TokenPrefix(key),
+		Hash:      HashToken(secret, key),
+		Key:       key,
+		CreatedAt: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		t.ExpiresAt = sql.NullTime{Time: t.CreatedAt.Add(ttl), Valid: true}
+	}
+	return t, nil
+}
+
+func (t *AuthToken) IsExpired(now time.Time) bool {
+	return t.ExpiresAt.Valid && !now.Before(t.ExpiresAt.Time)
+}
+
+func (t *AuthToken) IsRevoked() bool {
+	return t.RevokedAt.Valid
+}
+
+const insertAuthToken = "insert into tokens (id, user_id, prefix, hash, created_at, expires_at) values (?,?,?,?,?,?)"
+
+func (dbw *DBWorker) SaveNewAuthToken(ctx context.Context, t *AuthToken) error {
+	return dbw.WriteOneContext(ctx, insertAuthToken, t.ID, t.UserID, t.Prefix, t.Hash, t.CreatedAt, t.ExpiresAt)
+}
+
+// Finds token by its prefix and checks hash of the whole key made with secret
+func (dbw *DBWorker) LoadAuthToken(ctx context.Context, t *AuthToken, key string, secret []byte) error {
+	var candidates []AuthToken
+	if err := dbw.SelectContext(ctx, &candidates, "select * from tokens where prefix=?", TokenPrefix(key)); err != nil {
+		return err
+	}
+	hash := HashToken(secret, key)
+	for _, c := range candidates {
+		if TokenHashEqual(c.Hash, hash) {
+			*t = c
+			return nil
+		}
+	}
+	return NotFoundError{Msg: "TokenNotFound"}
+}
+
+func (dbw *DBWorker) RevokeAuthToken(ctx context.Context, t *AuthToken) error {
+	t.RevokedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	return dbw.WriteOneContext(ctx, "update tokens set revoked_at=? where id=?", t.RevokedAt, t.ID)
+}
+
+// Saves new token and revokes the old one in one transaction.
+// Returns NotFoundError if the old token is revoked already.
+func (dbw *DBWorker) RotateAuthToken(ctx context.Context, old, t *AuthToken) error {
+	dbw.mu.Lock()
+	defer dbw.mu.Unlock()
+	ctx, cancel := dbw.queryContext(ctx)
+	defer cancel()
+	tx, err := dbw.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	revokedAt := sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	res, err := tx.ExecContext(ctx, "update tokens set revoked_at=? where id=? and revoked_at is null", revokedAt, old.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return NotFoundError{Msg: "TokenNotFound"}
+	}
+	_, err = tx.ExecContext(ctx, insertAuthToken, t.ID, t.UserID, t.Prefix, t.Hash, t.CreatedAt, t.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	old.RevokedAt = revokedAt
+	return nil
+}
+
+func (dbw *DBWorker) TouchAuthToken(ctx context.Context, t *AuthToken) error {
+	t.LastUsedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	return dbw.WriteOneContext(ctx, "update tokens set last_used_at=? where id=?", t.LastUsedAt, t.ID)
+}
+
+func NewInviteCode() (*InviteCode, error) {
+	code, err := NewToken()
+	if err != nil {
+		return nil, err
+	}
+	return &InviteCode{Code: code, CreatedAt: time.Now().UTC()}, nil
+}
+
+func (dbw *DBWorker) SaveNewInviteCode(ctx context.Context, code *InviteCode) error {
+	return dbw.WriteOneContext(ctx, "insert into invite_codes (code, created_at) values (?,?)", code.Code, code.CreatedAt)
+}
+
+func (dbw *DBWorker) LoadInviteCode(ctx context.Context, code *InviteCode, value string) error {
+	return dbw.GetContext(ctx, code, "select * from invite_codes where code=?", value)
+}
+
 func NewJob(userID, kind string) (*Job, error) {
-	if !JobKind[kind] {
+	if _, ok := LookupProcessor(kind); !ok {
 		return nil, errors.New("Wrong job kind.")
 	}
 	job := &Job{}
@@ -171,22 +337,166 @@ func NewJob(userID, kind string) (*Job, error) {
 	job.UserID = userID
 	job.State = JobStateStarted
 	job.Kind = kind
+	job.CreatedAt = time.Now().UTC()
 	return job, nil
 }
 
-func (dbw *DBWorker) SaveNewJob(job *Job) error {
-	return dbw.WriteOne("insert into jobs (id, user_id, state, kind) values(?,?,?,?)", job.ID, job.UserID, job.State, job.Kind)
+// Marks job as picked up by a worker
+func (job *Job) Start() {
+	job.StartedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
 }
 
-func (dbw *DBWorker) SaveJob(job *Job) error {
-	return dbw.WriteOne("update jobs set state = ? where id = ?", job.State, job.ID)
+// Sets final state of the job depending on err
+func (job *Job) Finish(err error) {
+	if err != nil {
+		job.State = JobStateFailed
+		job.Error = err.Error()
+	} else {
+		job.State = JobStateDone
+		job.Error = ""
+	}
+	job.FinishedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+}
+
+func (job *Job) StateName() string {
+	return JobStateNames[job.State]
+}
+
+func insertJobStmt(job *Job) *SQL {
+	return sqlStmt("insert into jobs (id, user_id, state, kind, error, created_at, params, batch_id, instance) values(?,?,?,?,?,?,?,?,?)",
+		job.ID, job.UserID, job.State, job.Kind, job.Error, job.CreatedAt, job.Params, job.BatchID, job.Instance)
+}
+
+func (dbw *DBWorker) SaveNewJob(ctx context.Context, job *Job) error {
+	return dbw.WriteContext(ctx, insertJobStmt(job))
+}
+
+func (dbw *DBWorker) SaveJob(ctx context.Context, job *Job) error {
+	return dbw.WriteOneContext(ctx, "update jobs set state=?, error=?, started_at=?, finished_at=? where id=?",
+		job.State, job.Error, job.StartedAt, job.FinishedAt, job.ID)
+}
+
+// Returns jobs of the server instance not finished yet oldest first
+func (dbw *DBWorker) UnfinishedJobs(ctx context.Context, instance string) ([]Job, error) {
+	var jobs []Job
+	err := dbw.SelectContext(ctx, &jobs, "select * from jobs where state=? and instance=? order by id", JobStateStarted, instance)
+	return jobs, err
 }
 
-func (dbw *DBWorker) LoadJob(j *Job, jobID string) error {
-	return dbw.Get(j, "select * from jobs where id=?", jobID)
+func (dbw *DBWorker) LoadJob(ctx context.Context, j *Job, jobID string) error {
+	return dbw.GetContext(ctx, j, "select * from jobs where id=?", jobID)
 }
 
-func NewImage(job *Job, mediaRoot, fileName, mimeType string) (*Image, error) {
+// Selects jobs of a user for listing, empty fields do not filter
+type JobFilter struct {
+	UserID string
+	Kind   string
+	// Filters by state when not nil
+	State *int64
+	// Only jobs created before the one with this ID are selected
+	Before string
+	Limit  int
+}
+
+// Returns jobs matching the filter newest first
+func (dbw *DBWorker) ListJobs(ctx context.Context, f JobFilter) ([]Job, error) {
+	query := "select * from jobs where user_id=?"
+	args := []interface{}{f.UserID}
+	if f.Kind != "" {
+		query += " and kind=?"
+		args = append(args, f.Kind)
+	}
+	if f.State != nil {
+		query += " and state=?"
+		args = append(args, *f.State)
+	}
+	if f.Before != "" {
+		query += " and id<?"
+		args = append(args, f.Before)
+	}
+	query += " order by id desc limit ?"
+	args = append(args, f.Limit)
+	var jobs []Job
+	err := dbw.SelectContext(ctx, &jobs, query, args...)
+	return jobs, err
+}
+
+// Jobs of one kind and parameters submitted together
+type Batch struct {
+	ID        string
+	UserID    string `db:"user_id"`
+	Kind      string
+	Params    JobParams
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func NewBatch(userID, kind string) (*Batch, error) {
+	if _, ok := LookupProcessor(kind); !ok {
+		return nil, errors.New("Wrong job kind.")
+	}
+	id, err := NewULIDNow()
+	if err != nil {
+		return nil, err
+	}
+	return &Batch{ID: id, UserID: userID, Kind: kind, CreatedAt: time.Now().UTC()}, nil
+}
+
+// Returns new job of the batch
+func (batch *Batch) NewJob() (*Job, error) {
+	job, err := NewJob(batch.UserID, batch.Kind)
+	if err != nil {
+		return nil, err
+	}
+	job.Params = batch.Params
+	job.BatchID = batch.ID
+	return job, nil
+}
+
+// Saves batch with its jobs in one transaction
+func (dbw *DBWorker) SaveNewBatch(ctx context.Context, batch *Batch, jobs []*Job) error {
+	sqls := []*SQL{sqlStmt("insert into batches (id, user_id, kind, params, created_at) values(?,?,?,?,?)",
+		batch.ID, batch.UserID, batch.Kind, batch.Params, batch.CreatedAt)}
+	for _, job := range jobs {
+		sqls = append(sqls, insertJobStmt(job))
+	}
+	return dbw.WriteContext(ctx, sqls...)
+}
+
+func (dbw *DBWorker) LoadBatch(ctx context.Context, batch *Batch, id string) error {
+	return dbw.GetContext(ctx, batch, "select * from batches where id=?", id)
+}
+
+func (dbw *DBWorker) BatchJobs(ctx context.Context, batchID string) ([]Job, error) {
+	var jobs []Job
+	err := dbw.SelectContext(ctx, &jobs, "select * from jobs where batch_id=? order by id", batchID)
+	return jobs, err
+}
+
+// Returns IDs of images produced by each of the jobs
+func (dbw *DBWorker) JobImageIDs(ctx context.Context, jobIDs []string) (map[string][]string, error) {
+	ids := make(map[string][]string)
+	if len(jobIDs) == 0 {
+		return ids, nil
+	}
+	query, args, err := sqlx.In("select id, job_id from images where job_id in (?) order by id", jobIDs)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID    string
+		JobID string `db:"job_id"`
+	}
+	if err := dbw.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		ids[row.JobID] = append(ids[row.JobID], row.ID)
+	}
+	return ids, nil
+}
+
+// Returns image of the job, its path is the storage key
+func NewImage(job *Job, fileName, mimeType string) (*Image, error) {
 	img := &Image{}
 	id, err := NewULIDNow()
 	if err != nil {
@@ -195,29 +505,158 @@ func NewImage(job *Job, mediaRoot, fileName, mimeType string) (*Image, error) {
 	img.ID = id
 	img.JobID = job.ID
 	img.UserID = job.UserID
-	img.Path = filepath.Join(mediaRoot, fmt.Sprintf("%s_%s", id, fileName))
+	img.Path = fmt.Sprintf("%s_%s", id, fileName)
 	img.MimeType = mimeType
 	return img, nil
 }
 
-func NewImageFromForm(job *Job, mediaRoot string, fileHeader *multipart.FileHeader) (*Image, error) {
-	contentType, ok := fileHeader.Header["Content-Type"]
-	if !ok {
-		return nil, errors.New("Content-Type not provided.")
+func NewImageFromUpload(job *Job, upload *Upload) (*Image, error) {
+	dbImg, err := NewImage(job, upload.FileName, upload.MimeType)
+	if err != nil {
+		return nil, err
 	}
-	_, fileName := filepath.Split(fileHeader.Filename)
-	dbImg, _ := NewImage(job, mediaRoot, fileName, contentType[0])
-	dbImg.Size = fileHeader.Size
+	dbImg.Size = upload.Size
 	return dbImg, nil
 }
 
-func (dbw *DBWorker) SaveNewImage(img *Image) error {
-	_, err := dbw.NamedExec(`insert into images (
-		id, job_id, user_id, path, mime_type, size, width, height) values (
-		:id, :job_id, :user_id, :path, :mime_type, :size, :width, :height)`, img)
-	return err
+func insertImageStmt(img *Image) *SQL {
+	return sqlStmt(`insert into images (
+		id, job_id, user_id, kind, path, mime_type, size, width, height, digest, source_digest) values (
+		?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		img.ID, img.JobID, img.UserID, img.Kind, img.Path, img.MimeType,
+		img.Size, img.Width, img.Height, img.Digest, img.SourceDigest)
+}
+
+func (dbw *DBWorker) SaveNewImage(ctx context.Context, img *Image) error {
+	return dbw.WriteContext(ctx, insertImageStmt(img))
+}
+
+// Saves images in one transaction, none of them is saved on error
+func (dbw *DBWorker) SaveNewImages(ctx context.Context, imgs []*Image) error {
+	if len(imgs) == 0 {
+		return nil
+	}
+	sqls := make([]*SQL, 0, len(imgs))
+	for _, img := range imgs {
+		sqls = append(sqls, insertImageStmt(img))
+	}
+	return dbw.WriteContext(ctx, sqls...)
+}
+
+func (dbw *DBWorker) LoadImage(ctx context.Context, img *Image, id string) error {
+	return dbw.GetContext(ctx, img, "select * from images where id = ?", id)
+}
+
+// Loads the latest image of the kind made from upload with the digest by job with the same params
+func (dbw *DBWorker) LoadDerivedImage(ctx context.Context, img *Image, sourceDigest, kind string, params JobParams) error {
+	return dbw.GetContext(ctx, img, `select images.* from images join jobs on jobs.id=images.job_id
+		where images.source_digest=? and images.kind=? and images.digest!='' and jobs.params=?
+		order by images.id desc limit 1`, sourceDigest, kind, params)
+}
+
+// Tells if any image points to the path
+func (dbw *DBWorker) ImagePathUsed(ctx context.Context, path string) (bool, error) {
+	var count int
+	err := dbw.GetContext(ctx, &count, "select count(*) from images where path=?", path)
+	return count > 0, err
+}
+
+// Keeps file at the path from being removed as unused until returned function
+// is called. Jobs pin paths of their images before they check the files exist
+// and release them once the images are saved or the job fails. Waits for
+// removal of the file if it is in progress.
+func (dbw *DBWorker) PinImagePath(path string) func() {
+	dbw.mu.Lock()
+	defer dbw.mu.Unlock()
+	for dbw.removing[path] != nil {
+		done := dbw.removing[path]
+		dbw.mu.Unlock()
+		<-done
+		dbw.mu.Lock()
+	}
+	dbw.pinned[path]++
+	return func() {
+		dbw.mu.Lock()
+		defer dbw.mu.Unlock()
+		if dbw.pinned[path]--; dbw.pinned[path] <= 0 {
+			delete(dbw.pinned, path)
+		}
+	}
+}
+
+// Removes object at the path from storage unless an image points to it or
+// a job pinned it. Check is done under the write lock and the path is marked
+// as being removed, so jobs pinning it meanwhile wait and store the file again.
+// Storage is called without the lock. Tells if the file was removed.
+func (dbw *DBWorker) RemoveUnusedFile(ctx context.Context, storage Storage, path string) (bool, error) {
+	dbw.mu.Lock()
+	if dbw.pinned[path] > 0 || dbw.removing[path] != nil {
+		dbw.mu.Unlock()
+		return false, nil
+	}
+	used, err := dbw.ImagePathUsed(ctx, path)
+	if err != nil || used {
+		dbw.mu.Unlock()
+		return false, err
+	}
+	done := make(chan struct{})
+	dbw.removing[path] = done
+	dbw.mu.Unlock()
+
+	err = storage.Delete(ctx, path)
+	dbw.mu.Lock()
+	delete(dbw.removing, path)
+	close(done)
+	dbw.mu.Unlock()
+	return err == nil, err
+}
+
+func (dbw *DBWorker) JobImages(ctx context.Context, jobID string) ([]Image, error) {
+	var imgs []Image
+	err := dbw.SelectContext(ctx, &imgs, "select * from images where job_id=? order by id", jobID)
+	return imgs, err
+}
+
+func (dbw *DBWorker) DeleteImage(ctx context.Context, img *Image) error {
+	return dbw.WriteContext(ctx, sqlStmt("delete from images where id=?", img.ID))
 }
 
-func (dbw *DBWorker) LoadImage(img *Image, id string) error {
-	return dbw.Get(img, "select * from images where id = ?", id)
+// Deletes job together with its images
+func (dbw *DBWorker) DeleteJob(ctx context.Context, job *Job) error {
+	return dbw.WriteContext(ctx,
+		sqlStmt("delete from images where job_id=?", job.ID),
+		sqlStmt("delete from jobs where id=?", job.ID))
+}
+
+// Selects images of a user for listing, empty fields do not filter
+type ImageFilter struct {
+	UserID string
+	JobID  string
+	Kind   string
+	// Only images created before the one with this ID are selected
+	Before string
+	Limit  int
+}
+
+// Returns images matching the filter newest first
+func (dbw *DBWorker) ListImages(ctx context.Context, f ImageFilter) ([]Image, error) {
+	query := "select * from images where user_id=?"
+	args := []interface{}{f.UserID}
+	if f.JobID != "" {
+		query += " and job_id=?"
+		args = append(args, f.JobID)
+	}
+	if f.Kind != "" {
+		query += " and kind=?"
+		args = append(args, f.Kind)
+	}
+	if f.Before != "" {
+		query += " and id<?"
+		args = append(args, f.Before)
+	}
+	query += " order by id desc limit ?"
+	args = append(args, f.Limit)
+	var imgs []Image
+	err := dbw.SelectContext(ctx, &imgs, query, args...)
+	return imgs, err
 }
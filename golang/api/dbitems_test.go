@@ -1,8 +1,11 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -26,13 +29,13 @@ func TestUserNewSave(t *testing.T) {
 	if assert.Nil(t, err) {
 		defer removeWorker(dbw)
 	}
-	assert.Nil(t, dbw.CreateUserTable())
+	assert.Nil(t, dbw.CreateTables())
 	user, err := NewUser("foo", "bar")
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.SaveNewUser(user))
+	assert.Nil(t, dbw.SaveNewUser(context.Background(), user))
 	var u User
-	assert.Nil(t, dbw.QueryRow("select id, username, password, token from users where id=?", user.ID).Scan(
-		&u.ID, &u.Username, &u.Password, &u.Token))
+	assert.Nil(t, dbw.QueryRow("select id, username, password from users where id=?", user.ID).Scan(
+		&u.ID, &u.Username, &u.Password))
 	assert.True(t, u.IsPasswdValid("bar"))
 	assert.Equal(t, "foo", u.Username)
 }
@@ -42,19 +45,19 @@ func TestUserLoad(t *testing.T) {
 	if assert.Nil(t, err) {
 		defer removeWorker(dbw)
 	}
-	assert.Nil(t, dbw.CreateUserTable())
+	assert.Nil(t, dbw.CreateTables())
 	user1, err := NewUser("foo", "bar")
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.SaveNewUser(user1))
+	assert.Nil(t, dbw.SaveNewUser(context.Background(), user1))
 	user2, err := NewUser("spam", "egg")
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.SaveNewUser(user2))
+	assert.Nil(t, dbw.SaveNewUser(context.Background(), user2))
 	var u2 User
-	err = dbw.LoadUser(&u2, user2.ID)
+	err = dbw.LoadUser(context.Background(), &u2, user2.ID)
 	assert.Nil(t, err)
 	assert.Equal(t, "spam", u2.Username)
 	var u1 User
-	err = dbw.LoadUserByName(&u1, user1.Username)
+	err = dbw.LoadUserByName(context.Background(), &u1, user1.Username)
 	assert.Nil(t, err)
 	assert.Equal(t, u1.ID, user1.ID)
 }
@@ -64,17 +67,16 @@ func TestUserUpdate(t *testing.T) {
 	if assert.Nil(t, err) {
 		defer removeWorker(dbw)
 	}
-	assert.Nil(t, dbw.CreateUserTable())
+	assert.Nil(t, dbw.CreateTables())
 	user, err := NewUser("foo", "bar")
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.SaveNewUser(user))
-	token, _ := NewToken()
-	user.Token = token
-	assert.Nil(t, dbw.SaveUser(user))
+	assert.Nil(t, dbw.SaveNewUser(context.Background(), user))
+	user.Username = "spam"
+	assert.Nil(t, dbw.SaveUser(context.Background(), user))
 	var u User
-	err = dbw.LoadUser(&u, user.ID)
+	err = dbw.LoadUser(context.Background(), &u, user.ID)
 	assert.Nil(t, err)
-	assert.Equal(t, token, u.Token)
+	assert.Equal(t, "spam", u.Username)
 
 }
 
@@ -90,12 +92,11 @@ func TestJobNewSave(t *testing.T) {
 	if assert.Nil(t, err) {
 		defer removeWorker(dbw)
 	}
-	_ = dbw.CreateUserTable()
-	_ = dbw.CreateJobTable()
+	assert.Nil(t, dbw.CreateTables())
 	user, _ := NewUser("foo", "bar")
 	job, _ := NewJob(user.ID, JOB_ALL_THREE)
-	dbw.SaveNewUser(user)
-	dbw.SaveNewJob(job)
+	dbw.SaveNewUser(context.Background(), user)
+	dbw.SaveNewJob(context.Background(), job)
 	var job_id, user_id, state string
 	assert.Nil(t, dbw.QueryRow("select id, user_id, state from jobs where id = ?", job.ID).Scan(&job_id, &user_id, &state))
 }
@@ -105,33 +106,62 @@ func TestJobSave(t *testing.T) {
 	if assert.Nil(t, err) {
 		defer removeWorker(dbw)
 	}
-	_ = dbw.CreateUserTable()
-	_ = dbw.CreateJobTable()
+	assert.Nil(t, dbw.CreateTables())
 	user, _ := NewUser("foo", "bar")
 	job, _ := NewJob(user.ID, "original")
-	dbw.SaveNewUser(user)
-	dbw.SaveNewJob(job)
+	dbw.SaveNewUser(context.Background(), user)
+	dbw.SaveNewJob(context.Background(), job)
 	assert.Equal(t, int64(0), job.State)
 	job.State = 1
-	assert.Nil(t, dbw.SaveJob(job))
+	assert.Nil(t, dbw.SaveJob(context.Background(), job))
 	var job_state int64
 	assert.Nil(t, dbw.QueryRow("select state from jobs where id = ?", job.ID).Scan(&job_state))
 	assert.Equal(t, int64(1), job_state)
 }
 
+func TestJobFinish(t *testing.T) {
+	dbw, err := testDBWorker()
+	if assert.Nil(t, err) {
+		defer removeWorker(dbw)
+	}
+	assert.Nil(t, dbw.CreateTables())
+	user, _ := NewUser("foo", "bar")
+	job, _ := NewJob(user.ID, JOB_ORIG)
+	assert.Nil(t, dbw.SaveNewUser(context.Background(), user))
+	assert.Nil(t, dbw.SaveNewJob(context.Background(), job))
+	var j Job
+	assert.Nil(t, dbw.LoadJob(context.Background(), &j, job.ID))
+	assert.Equal(t, "started", j.StateName())
+	assert.False(t, j.StartedAt.Valid)
+	assert.True(t, job.CreatedAt.Equal(j.CreatedAt))
+	job.Start()
+	job.Finish(errors.New("Boom."))
+	assert.Nil(t, dbw.SaveJob(context.Background(), job))
+	assert.Nil(t, dbw.LoadJob(context.Background(), &j, job.ID))
+	assert.Equal(t, int64(JobStateFailed), j.State)
+	assert.Equal(t, "Boom.", j.Error)
+	assert.True(t, j.StartedAt.Valid)
+	assert.True(t, j.FinishedAt.Valid)
+	assert.False(t, j.FinishedAt.Time.Before(j.StartedAt.Time))
+	job.Finish(nil)
+	assert.Nil(t, dbw.SaveJob(context.Background(), job))
+	assert.Nil(t, dbw.LoadJob(context.Background(), &j, job.ID))
+	assert.Equal(t, "done", j.StateName())
+	assert.Equal(t, "", j.Error)
+}
+
 func TestJobLoad(t *testing.T) {
 	dbw, err := testDBWorker()
 	if assert.Nil(t, err) {
 		defer removeWorker(dbw)
 	}
-	_ = dbw.CreateUserTable()
-	_ = dbw.CreateJobTable()
+	assert.Nil(t, dbw.CreateTables())
 	user, _ := NewUser("foo", "bar")
 	job, _ := NewJob(user.ID, JOB_SQUARE_ORIG)
-	dbw.SaveNewUser(user)
-	dbw.SaveNewJob(job)
+	dbw.SaveNewUser(context.Background(), user)
+	dbw.SaveNewJob(context.Background(), job)
 	var j Job
-	err = dbw.LoadJob(&j, job.ID)
+	err = dbw.LoadJob(context.Background(), &j, job.ID)
 	assert.Nil(t, err)
 	assert.Equal(t, user.ID, j.UserID)
 }
@@ -139,8 +169,8 @@ func TestJobLoad(t *testing.T) {
 func TestImageNew(t *testing.T) {
 	user, _ := NewUser("foo", "bar")
 	job, _ := NewJob(user.ID, JOB_ORIG)
-	img, _ := NewImage(job, "/tmp", "foo.jpg", "image/jpeg")
-	assert.Equal(t, fmt.Sprintf("/tmp/%s_foo.jpg", img.ID), img.Path)
+	img, _ := NewImage(job, "foo.jpg", "image/jpeg")
+	assert.Equal(t, fmt.Sprintf("%s_foo.jpg", img.ID), img.Path)
 }
 
 func TestImageSaveNew(t *testing.T) {
@@ -148,15 +178,13 @@ func TestImageSaveNew(t *testing.T) {
 	if assert.Nil(t, err) {
 		defer removeWorker(dbw)
 	}
-	_ = dbw.CreateUserTable()
-	_ = dbw.CreateJobTable()
-	assert.Nil(t, dbw.CreateImageTable())
+	assert.Nil(t, dbw.CreateTables())
 	user, _ := NewUser("foo", "bar")
 	job, _ := NewJob(user.ID, JOB_ORIG)
-	img, _ := NewImage(job, "/tmp/", "foo.jpg", "image/jpeg")
-	dbw.SaveNewUser(user)
-	dbw.SaveNewJob(job)
-	assert.Nil(t, dbw.SaveNewImage(img))
+	img, _ := NewImage(job, "foo.jpg", "image/jpeg")
+	dbw.SaveNewUser(context.Background(), user)
+	dbw.SaveNewJob(context.Background(), job)
+	assert.Nil(t, dbw.SaveNewImage(context.Background(), img))
 	var path string
 	dbw.QueryRow("select path from images where id=?", img.ID).Scan(&path)
 	assert.Equal(t, img.Path, path)
@@ -167,17 +195,92 @@ func TestImageLoad(t *testing.T) {
 	if assert.Nil(t, err) {
 		defer removeWorker(dbw)
 	}
-	_ = dbw.CreateUserTable()
-	_ = dbw.CreateJobTable()
-	assert.Nil(t, dbw.CreateImageTable())
+	assert.Nil(t, dbw.CreateTables())
 	user, _ := NewUser("foo", "bar")
 	job, _ := NewJob(user.ID, JOB_ORIG)
-	img, _ := NewImage(job, "/tmp/", "foo.jpg", "image/jpeg")
-	dbw.SaveNewUser(user)
-	dbw.SaveNewJob(job)
-	assert.Nil(t, dbw.SaveNewImage(img))
+	img, _ := NewImage(job, "foo.jpg", "image/jpeg")
+	dbw.SaveNewUser(context.Background(), user)
+	dbw.SaveNewJob(context.Background(), job)
+	assert.Nil(t, dbw.SaveNewImage(context.Background(), img))
 	var imgLoaded Image
-	err = dbw.LoadImage(&imgLoaded, img.ID)
+	err = dbw.LoadImage(context.Background(), &imgLoaded, img.ID)
 	assert.Nil(t, err)
 	assert.Equal(t, img.ID, imgLoaded.ID)
 }
+
+func TestInviteCodeUse(t *testing.T) {
+	dbw, err := testDBWorker()
+	if assert.Nil(t, err) {
+		defer removeWorker(dbw)
+	}
+	assert.Nil(t, dbw.CreateTables())
+	code, err := NewInviteCode()
+	assert.Nil(t, err)
+	assert.Nil(t, dbw.SaveNewInviteCode(context.Background(), code))
+	user1, _ := NewUser("foo", "bar")
+	assert.Nil(t, dbw.SaveNewUserWithInvite(context.Background(), user1, code.Code))
+	user2, _ := NewUser("spam", "egg")
+	assert.True(t, IsNotFound(dbw.SaveNewUserWithInvite(context.Background(), user2, code.Code)))
+	assert.True(t, IsNotFound(dbw.LoadUser(context.Background(), &User{}, user2.ID)))
+	user3, _ := NewUser("foo", "egg")
+	assert.True(t, IsUniqueViolation(dbw.SaveNewUser(context.Background(), user3)))
+}
+
+func TestAuthToken(t *testing.T) {
+	dbw, err := testDBWorker()
+	if assert.Nil(t, err) {
+		defer removeWorker(dbw)
+	}
+	ctx := context.Background()
+	assert.Nil(t, dbw.CreateTables())
+	user, _ := NewUser("foo", "bar")
+	assert.Nil(t, dbw.SaveNewUser(ctx, user))
+	secret := []byte("secret")
+	token, err := NewAuthToken(user.ID, time.Hour, secret)
+	assert.Nil(t, err)
+	assert.Nil(t, dbw.SaveNewAuthToken(ctx, token))
+	var loaded AuthToken
+	assert.Nil(t, dbw.LoadAuthToken(ctx, &loaded, token.Key, secret))
+	assert.Equal(t, "", loaded.Key)
+	assert.Equal(t, token.Hash, loaded.Hash)
+	assert.NotContains(t, loaded.Hash, token.Key)
+	assert.True(t, IsNotFound(dbw.LoadAuthToken(ctx, &loaded, token.Key, []byte("other"))))
+	assert.True(t, IsNotFound(dbw.LoadAuthToken(ctx, &loaded, token.Prefix, secret)))
+	assert.False(t, loaded.IsExpired(time.Now()))
+	assert.True(t, loaded.IsExpired(time.Now().Add(2*time.Hour)))
+	assert.False(t, loaded.IsRevoked())
+	assert.Nil(t, dbw.TouchAuthToken(ctx, &loaded))
+
+	newToken, _ := NewAuthToken(user.ID, 0, secret)
+	assert.Nil(t, dbw.RotateAuthToken(ctx, &loaded, newToken))
+	assert.Nil(t, dbw.LoadAuthToken(ctx, &loaded, token.Key, secret))
+	assert.True(t, loaded.IsRevoked())
+	assert.True(t, loaded.LastUsedAt.Valid)
+	assert.Nil(t, dbw.LoadAuthToken(ctx, &loaded, newToken.Key, secret))
+	assert.False(t, loaded.IsRevoked())
+	assert.False(t, loaded.IsExpired(time.Now().Add(1000*time.Hour)))
+
+	// revoked token can not be rotated, concurrent rotations issue one token
+	other, _ := NewAuthToken(user.ID, 0, secret)
+	assert.True(t, IsNotFound(dbw.RotateAuthToken(ctx, &AuthToken{ID: token.ID}, other)))
+	assert.True(t, IsNotFound(dbw.LoadAuthToken(ctx, &AuthToken{}, other.Key, secret)))
+	results := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			rotated, _ := NewAuthToken(user.ID, 0, secret)
+			results <- dbw.RotateAuthToken(ctx, &AuthToken{ID: loaded.ID}, rotated)
+		}()
+	}
+	succeeded := 0
+	for i := 0; i < 5; i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		} else {
+			assert.True(t, IsNotFound(err))
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+	assert.Nil(t, dbw.RevokeAuthToken(ctx, &loaded))
+	assert.Nil(t, dbw.LoadAuthToken(ctx, &loaded, newToken.Key, secret))
+	assert.True(t, loaded.IsRevoked())
+}
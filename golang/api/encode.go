@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const DefaultJPEGQuality = 95
+
+// PNG compression levels by the names accepted in png_compression parameter
+var PNGCompressions = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// How outputs of a job are encoded, parsed from output_format,
+// jpeg_quality, png_compression and strip_metadata parameters
+type outputParams struct {
+	// Nil means the format of the upload
+	Format         *ImageFormat
+	JPEGQuality    int
+	PNGCompression png.CompressionLevel
+	// Drop metadata of the upload from original kind, derived kinds never have it
+	StripMetadata bool
+}
+
+func formatNames() string {
+	names := make([]string, 0, len(ImageFormats))
+	for _, f := range ImageFormats {
+		names = append(names, f.Name())
+	}
+	return strings.Join(names, ", ")
+}
+
+func compressionNames() string {
+	names := make([]string, 0, len(PNGCompressions))
+	for name := range PNGCompressions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func parseOutputParams(params map[string]string) (*outputParams, error) {
+	p := &outputParams{JPEGQuality: DefaultJPEGQuality, PNGCompression: png.DefaultCompression}
+	if name := params["output_format"]; name != "" {
+		if p.Format = LookupImageFormat(name); p.Format == nil {
+			return nil, fmt.Errorf("Wrong output format, allowed formats are %s.", formatNames())
+		}
+	}
+	if value := params["jpeg_quality"]; value != "" {
+		q, err := strconv.Atoi(value)
+		if err != nil || q < 1 || q > 100 {
+			return nil, errors.New("Wrong jpeg_quality, it should be a number from 1 to 100.")
+		}
+		p.JPEGQuality = q
+	}
+	if name := params["png_compression"]; name != "" {
+		var ok bool
+		if p.PNGCompression, ok = PNGCompressions[name]; !ok {
+			return nil, fmt.Errorf("Wrong png_compression, allowed values are %s.", compressionNames())
+		}
+	}
+	if value := params["strip_metadata"]; value != "" {
+		var err error
+		if p.StripMetadata, err = strconv.ParseBool(value); err != nil {
+			return nil, errors.New("Wrong strip_metadata, it should be true or false.")
+		}
+	}
+	return p, nil
+}
+
+// Returns format outputs made from the upload are encoded in
+func (p *outputParams) formatFor(upload *Upload) (*ImageFormat, error) {
+	if p.Format != nil {
+		return p.Format, nil
+	}
+	format := LookupImageFormat(strings.TrimPrefix(filepath.Ext(upload.FileName), "."))
+	if format == nil {
+		return nil, UnsupportedFormatError{}
+	}
+	return format, nil
+}
+
+// Tells whether uploaded file can be stored as it is,
+// it can not when the job asks for another format
+func (p *outputParams) keepsRaw(upload *Upload) bool {
+	if p.Format == nil {
+		return true
+	}
+	return p.Format.HasExt(filepath.Ext(upload.FileName))
+}
+
+func (p *outputParams) encode(w io.Writer, img image.Image, format *ImageFormat) error {
+	return imaging.Encode(w, img, format.Encoding,
+		imaging.JPEGQuality(p.JPEGQuality), imaging.PNGCompressionLevel(p.PNGCompression))
+}
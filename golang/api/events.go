@@ -0,0 +1,120 @@
+package api
+
+import (
+	"sync"
+)
+
+// Types of job events
+const (
+	JobEventQueued  = "queued"
+	JobEventStarted = "started"
+	JobEventImage   = "image"
+	JobEventDone    = "done"
+	JobEventFailed  = "failed"
+)
+
+// Number of events kept for a subscriber not reading them yet,
+// subscriber falling further behind is dropped.
+const EventBufferSize = 32
+
+// Change of job state or image produced by it
+type JobEvent struct {
+	Type  string `json:"type"`
+	JobID string `json:"job_id"`
+	// Image and its kind for image events. Image events of running job are
+	// sent as its outputs are stored, before images are saved and get ids.
+	ImageID   string `json:"image_id,omitempty"`
+	ImageKind string `json:"image_kind,omitempty"`
+	// Saved images of the job for done events
+	ImageIDs []string `json:"image_ids,omitempty"`
+	// Reason of the failure for failed events
+	Error string `json:"error,omitempty"`
+}
+
+// Tells whether no more events of the job follow
+func (e JobEvent) Final() bool {
+	return e.Type == JobEventDone || e.Type == JobEventFailed
+}
+
+// In-process pub/sub of job events, nil hub drops everything
+type EventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan JobEvent]bool
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subs: make(map[string]map[chan JobEvent]bool)}
+}
+
+// Returns channel receiving events of the job published from now on and function
+// ending the subscription. Channel is closed if the subscriber falls behind.
+func (h *EventHub) Subscribe(jobID string) (<-chan JobEvent, func()) {
+	ch := make(chan JobEvent, EventBufferSize)
+	if h == nil {
+		return ch, func() {}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[jobID] == nil {
+		h.subs[jobID] = make(map[chan JobEvent]bool)
+	}
+	h.subs[jobID][ch] = true
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(jobID, ch)
+	}
+}
+
+// Removes subscriber and closes its channel, h.mu should be held
+func (h *EventHub) remove(jobID string, ch chan JobEvent) {
+	subs := h.subs[jobID]
+	if !subs[ch] {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(h.subs, jobID)
+	}
+}
+
+// Sends event to subscribers of its job without blocking
+func (h *EventHub) Publish(e JobEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[e.JobID] {
+		select {
+		case ch <- e:
+		default:
+			h.remove(e.JobID, ch)
+		}
+	}
+}
+
+// Returns events telling current state of the job, images are reported for done jobs
+func jobStateEvents(job *Job, imgs []Image) []JobEvent {
+	switch {
+	case job.State == JobStateStarted && !job.StartedAt.Valid:
+		return []JobEvent{{Type: JobEventQueued, JobID: job.ID}}
+	case job.State == JobStateStarted:
+		return []JobEvent{{Type: JobEventStarted, JobID: job.ID}}
+	}
+	return finishedJobEvents(job, imgs)
+}
+
+func finishedJobEvents(job *Job, imgs []Image) []JobEvent {
+	if job.State == JobStateFailed {
+		return []JobEvent{{Type: JobEventFailed, JobID: job.ID, Error: job.Error}}
+	}
+	events := make([]JobEvent, 0, len(imgs)+1)
+	done := JobEvent{Type: JobEventDone, JobID: job.ID}
+	for _, img := range imgs {
+		events = append(events, JobEvent{Type: JobEventImage, JobID: job.ID, ImageID: img.ID, ImageKind: img.Kind})
+		done.ImageIDs = append(done.ImageIDs, img.ID)
+	}
+	return append(events, done)
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventHub(t *testing.T) {
+	hub := NewEventHub()
+	events, unsubscribe := hub.Subscribe("job")
+	other, unsubscribeOther := hub.Subscribe("other")
+	defer unsubscribeOther()
+	hub.Publish(JobEvent{Type: JobEventStarted, JobID: "job"})
+	hub.Publish(JobEvent{Type: JobEventDone, JobID: "job"})
+	e := <-events
+	assert.Equal(t, JobEventStarted, e.Type)
+	e = <-events
+	assert.True(t, e.Final())
+	assert.Empty(t, other)
+
+	unsubscribe()
+	_, ok := <-events
+	assert.False(t, ok)
+	unsubscribe()
+	hub.Publish(JobEvent{Type: JobEventDone, JobID: "job"})
+
+	// subscriber falling behind is dropped
+	for i := 0; i <= EventBufferSize; i++ {
+		hub.Publish(JobEvent{Type: JobEventImage, JobID: "other"})
+	}
+	n := 0
+	for range other {
+		n++
+	}
+	assert.Equal(t, EventBufferSize, n)
+
+	var nilHub *EventHub
+	nilHub.Publish(JobEvent{Type: JobEventDone, JobID: "job"})
+	events, unsubscribe = nilHub.Subscribe("job")
+	unsubscribe()
+	require.NotNil(t, events)
+}
+
+func TestFinishedJobEvents(t *testing.T) {
+	job := &Job{ID: "job", State: JobStateDone}
+	events := finishedJobEvents(job, []Image{{ID: "a", Kind: JOB_ORIG}, {ID: "b", Kind: JOB_SQUARE_SMALL}})
+	require.Equal(t, 3, len(events))
+	assert.Equal(t, JobEvent{Type: JobEventImage, JobID: "job", ImageID: "b", ImageKind: JOB_SQUARE_SMALL}, events[1])
+	assert.Equal(t, JobEvent{Type: JobEventDone, JobID: "job", ImageIDs: []string{"a", "b"}}, events[2])
+
+	job = &Job{ID: "job", State: JobStateFailed, Error: "Processing failed."}
+	assert.Equal(t, []JobEvent{{Type: JobEventFailed, JobID: "job", Error: "Processing failed."}}, finishedJobEvents(job, nil))
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+const DefaultGCGrace = time.Hour
+
+type GCOptions struct {
+	// Remove orphan files, otherwise they are only reported
+	Delete bool
+	// Files modified more recently are never removed, jobs in progress
+	// write files before their images are saved.
+	Grace time.Duration
+}
+
+// Result of reconciling images table with objects in storage
+type GCReport struct {
+	// Keys of objects without images pointing to them
+	Orphans []string
+	// Images whose objects do not exist
+	Missing []Image
+	// Orphans that were removed
+	Deleted []string
+}
+
+// Returns storage key of the image, legacy images of local storage keep absolute paths
+func imageKey(storage Storage, img *Image) string {
+	if local, ok := storage.(*LocalStorage); ok {
+		return local.Key(img.Path)
+	}
+	return img.Path
+}
+
+// Compares images paths with objects in storage except staged uploads
+func (dbw *DBWorker) CollectGarbage(ctx context.Context, storage Storage, opts GCOptions) (*GCReport, error) {
+	var imgs []Image
+	if err := dbw.SelectContext(ctx, &imgs, "select * from images order by id"); err != nil {
+		return nil, err
+	}
+	objects, err := storage.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(imgs))
+	for i := range imgs {
+		known[imageKey(storage, &imgs[i])] = true
+	}
+	report := &GCReport{}
+	stored := make(map[string]bool, len(objects))
+	deadline := time.Now().Add(-opts.Grace)
+	for _, obj := range objects {
+		stored[obj.Key] = true
+		if known[obj.Key] || strings.HasPrefix(obj.Key, StagingDirName+"/") {
+			continue
+		}
+		report.Orphans = append(report.Orphans, obj.Key)
+		if !opts.Delete || obj.ModTime.After(deadline) {
+			continue
+		}
+		// image pointing to it may have been saved since it was listed
+		removed, err := dbw.RemoveUnusedFile(ctx, storage, obj.Key)
+		if err != nil {
+			return report, err
+		}
+		if removed {
+			report.Deleted = append(report.Deleted, obj.Key)
+		}
+	}
+	for i := range imgs {
+		if stored[imageKey(storage, &imgs[i])] {
+			continue
+		}
+		// legacy paths outside of storage root are not listed
+		_, err := storage.Stat(ctx, imgs[i].Path)
+		if IsNotFound(err) {
+			report.Missing = append(report.Missing, imgs[i])
+		} else if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// Logs what CollectGarbage found
+func (r *GCReport) Log() {
+	for _, key := range r.Orphans {
+		log.Printf("gc: orphan object %s", key)
+	}
+	for _, key := range r.Deleted {
+		log.Printf("gc: removed %s", key)
+	}
+	for _, img := range r.Missing {
+		log.Printf("gc: image %s misses object %s", img.ID, img.Path)
+	}
+}
+
+// Collects garbage every interval until ctx is done
+func (dbw *DBWorker) RunGC(ctx context.Context, storage Storage, interval time.Duration, opts GCOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := dbw.CollectGarbage(ctx, storage, opts)
+			if err != nil {
+				log.Printf("gc: %s", err.Error())
+			}
+			if report != nil {
+				report.Log()
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	ctx := context.Background()
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	require.Nil(t, os.MkdirAll(StagingDir(mediaRoot), os.ModePerm))
+	storage := NewLocalStorage(mediaRoot)
+
+	user, _ := createTestUser("foo", "bar", dbw)
+	job, _ := NewJob(user.ID, JOB_ORIG)
+	require.Nil(t, dbw.SaveNewJob(ctx, job))
+	kept, _ := NewImage(job, "kept.png", "image/png")
+	require.Nil(t, dbw.SaveNewImage(ctx, kept))
+	missing, _ := NewImage(job, "missing.png", "image/png")
+	require.Nil(t, dbw.SaveNewImage(ctx, missing))
+	// saved before storages with absolute path
+	legacy, _ := NewImage(job, "legacy.png", "image/png")
+	legacy.Path = filepath.Join(mediaRoot, legacy.Path)
+	require.Nil(t, dbw.SaveNewImage(ctx, legacy))
+
+	old := time.Now().Add(-2 * time.Hour)
+	staged := filepath.Join(StagingDirName, "upload.png")
+	for _, key := range []string{kept.Path, "old.png", "new.png", staged, storage.Key(legacy.Path)} {
+		_, err := storage.Put(ctx, key, bytes.NewBufferString("foo"))
+		require.Nil(t, err)
+	}
+	require.Nil(t, os.Chtimes(filepath.Join(mediaRoot, "old.png"), old, old))
+	require.Nil(t, os.Chtimes(filepath.Join(mediaRoot, staged), old, old))
+
+	report, err := dbw.CollectGarbage(ctx, storage, GCOptions{Grace: time.Hour})
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"old.png", "new.png"}, report.Orphans)
+	assert.Empty(t, report.Deleted)
+	require.Equal(t, 1, len(report.Missing))
+	assert.Equal(t, missing.ID, report.Missing[0].ID)
+
+	report, err = dbw.CollectGarbage(ctx, storage, GCOptions{Delete: true, Grace: time.Hour})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"old.png"}, report.Deleted)
+	assert.NoFileExists(t, filepath.Join(mediaRoot, "old.png"))
+	assert.FileExists(t, filepath.Join(mediaRoot, "new.png"))
+	assert.FileExists(t, filepath.Join(mediaRoot, staged))
+	assert.FileExists(t, filepath.Join(mediaRoot, kept.Path))
+	assert.FileExists(t, legacy.Path)
+}
@@ -1,17 +1,75 @@
 package api
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
 	"fmt"
+	"image"
+	"io"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	ulid "github.com/oklog/ulid/v2"
 )
 
 type App struct {
 	DBW        *DBWorker
 	MEDIA_ROOT string
+	// Shared code allowing anyone to sign up, single-use codes
+	// from invite_codes table are accepted regardless of it.
+	INVITE_CODE string
+	// Lifetime of issued tokens, zero means they never expire
+	TOKEN_TTL time.Duration
+	// Key of token hashes, issued tokens stop working when it changes
+	TOKEN_SECRET []byte
+	// Where images are kept, uploads are staged in MEDIA_ROOT regardless of it
+	Storage Storage
+	Queue   *JobQueue
+	// Limits of job uploads, MAX_PIXELS is checked before the image is decoded
+	MAX_BODY_SIZE int64
+	MAX_FILE_SIZE int64
+	MAX_PIXELS    int64
+	// Limits of batch submissions, every file of a batch is checked against the ones above
+	MAX_BATCH_BODY_SIZE int64
+	MAX_BATCH_FILES     int
+	// Name of the server instance jobs are accepted by, every instance sharing
+	// the database should have its own, see JobQueue.Recover
+	INSTANCE string
+}
+
+const DefaultTokenTTL = 30 * 24 * time.Hour
+
+// Returns random key for token hashes
+func NewTokenSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+func NewApp(dbw *DBWorker, mediaRoot string) *App {
+	storage := NewLocalStorage(mediaRoot)
+	return &App{
+		DBW:        dbw,
+		MEDIA_ROOT: mediaRoot,
+		TOKEN_TTL:  DefaultTokenTTL,
+		// tokens live until restart unless the secret is configured
+		TOKEN_SECRET:        NewTokenSecret(),
+		Storage:             storage,
+		Queue:               NewJobQueue(dbw, storage, DefaultWorkers, DefaultQueueSize),
+		MAX_BODY_SIZE:       DefaultMaxBodySize,
+		MAX_FILE_SIZE:       DefaultMaxFileSize,
+		MAX_PIXELS:          DefaultMaxPixels,
+		MAX_BATCH_BODY_SIZE: DefaultMaxBatchBodySize,
+		MAX_BATCH_FILES:     DefaultMaxBatchFiles,
+	}
 }
 
 type LoginCall struct {
@@ -19,6 +77,83 @@ type LoginCall struct {
 	Password string `json:"password"`
 }
 
+type RegisterCall struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+const MinPasswordLength = 8
+
+var usernameRe = regexp.MustCompile(`^[\w.@+-]{1,150}$`)
+
+func (app *App) isInviteCodeShared(code string) bool {
+	if app.INVITE_CODE == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(code), []byte(app.INVITE_CODE)) == 1
+}
+
+func (app *App) postApiRegister(c *gin.Context) {
+	var r RegisterCall
+	c.BindJSON(&r)
+	if r.Username == "" || r.Password == "" {
+		respondErr(c, 400, "Missing username or password.")
+		return
+	}
+	if !usernameRe.MatchString(r.Username) {
+		respondErr(c, 400, "Username may contain only letters, digits and @/./+/-/_ characters.")
+		return
+	}
+	if len(r.Password) < MinPasswordLength {
+		respondErr(c, 400, fmt.Sprintf("Password should be at least %d characters long.", MinPasswordLength))
+		return
+	}
+	if r.Code == "" {
+		respondErr(c, 400, "Invitation code wrong or missing.")
+		return
+	}
+	user, err := NewUser(r.Username, r.Password)
+	if err != nil {
+		respondErr(c, 500, "Could not create user.")
+		return
+	}
+	if app.isInviteCodeShared(r.Code) {
+		err = app.DBW.SaveNewUser(c.Request.Context(), user)
+	} else {
+		err = app.DBW.SaveNewUserWithInvite(c.Request.Context(), user, r.Code)
+	}
+	if err != nil {
+		switch {
+		case IsNotFound(err):
+			respondErr(c, 400, "Invitation code wrong or missing.")
+		case IsUniqueViolation(err):
+			respondErr(c, 400, "Username already exists.")
+		default:
+			respondErr(c, 500, fmt.Sprintf("Could not save user: %s", err.Error()))
+		}
+		return
+	}
+	token, err := app.issueToken(c, user.ID)
+	if err != nil {
+		respondErr(c, 500, "Could not issue token.")
+		return
+	}
+	c.JSON(200, gin.H{
+		"ok":    true,
+		"token": token.Key,
+	})
+}
+
+// Creates and saves new token for the user
+func (app *App) issueToken(c *gin.Context, userID string) (*AuthToken, error) {
+	token, err := NewAuthToken(userID, app.TOKEN_TTL, app.TOKEN_SECRET)
+	if err != nil {
+		return nil, err
+	}
+	return token, app.DBW.SaveNewAuthToken(c.Request.Context(), token)
+}
+
 func (app *App) postApiToken(c *gin.Context) {
 	var l LoginCall
 	c.BindJSON(&l)
@@ -30,7 +165,7 @@ func (app *App) postApiToken(c *gin.Context) {
 		return
 	}
 	var user User
-	err := app.DBW.LoadUserByName(&user, l.Username)
+	err := app.DBW.LoadUserByName(c.Request.Context(), &user, l.Username)
 	if err != nil {
 		var msg string
 		if IsNotFound(err) {
@@ -51,18 +186,71 @@ func (app *App) postApiToken(c *gin.Context) {
 		})
 		return
 	}
+	token, err := app.issueToken(c, user.ID)
+	if err != nil {
+		respondErr(c, 500, "Could not issue token.")
+		return
+	}
 	c.JSON(200, gin.H{
 		"ok":    true,
-		"token": user.Token,
+		"token": token.Key,
 	})
 
 }
 
+// Revokes token the request is authorized with
+func (app *App) postApiLogout(c *gin.Context) {
+	token, ok := c.MustGet("token").(*AuthToken)
+	if !ok {
+		respondErr(c, 401, "Not authorized")
+		return
+	}
+	if err := app.DBW.RevokeAuthToken(c.Request.Context(), token); err != nil {
+		respondErr(c, 500, "Could not revoke token.")
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// Replaces token the request is authorized with by a new one
+func (app *App) postApiTokenRotate(c *gin.Context) {
+	token, ok := c.MustGet("token").(*AuthToken)
+	if !ok {
+		respondErr(c, 401, "Not authorized")
+		return
+	}
+	newToken, err := NewAuthToken(token.UserID, app.TOKEN_TTL, app.TOKEN_SECRET)
+	if err != nil {
+		respondErr(c, 500, "Could not issue token.")
+		return
+	}
+	if err := app.DBW.RotateAuthToken(c.Request.Context(), token, newToken); err != nil {
+		if IsNotFound(err) {
+			respondErr(c, 401, "Authorization token no valid.")
+		} else {
+			respondErr(c, 500, "Could not issue token.")
+		}
+		return
+	}
+	c.JSON(200, gin.H{
+		"ok":    true,
+		"token": newToken.Key,
+	})
+}
+
 func respondErr(c *gin.Context, code int, msg string) {
 	c.AbortWithStatusJSON(code, gin.H{"ok": false, "error": msg})
 }
 
-func AuthMiddleware(dbw *DBWorker) gin.HandlerFunc {
+// Same as respondErr with errCode telling clients the reason
+func respondErrCode(c *gin.Context, code int, errCode, msg string) {
+	c.AbortWithStatusJSON(code, gin.H{"ok": false, "error": msg, "code": errCode})
+}
+
+// How often last use time of a token is updated
+const TokenTouchInterval = time.Minute
+
+func AuthMiddleware(dbw *DBWorker, secret []byte) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		h, ok := c.Request.Header["Authorization"]
 		if !ok {
@@ -74,13 +262,31 @@ func AuthMiddleware(dbw *DBWorker) gin.HandlerFunc {
 			respondErr(c, 401, "Authorization token no valid.")
 			return
 		}
+		ctx := c.Request.Context()
+		var authToken AuthToken
+		if err := dbw.LoadAuthToken(ctx, &authToken, token, secret); err != nil {
+			respondErr(c, 401, "Authorization token is not valid.")
+			return
+		}
+		now := time.Now()
+		if authToken.IsRevoked() {
+			respondErr(c, 401, "Authorization token is revoked.")
+			return
+		}
+		if authToken.IsExpired(now) {
+			respondErr(c, 401, "Authorization token has expired.")
+			return
+		}
 		var user User
-		err := dbw.LoadUserByToken(&user, token)
-		if err != nil {
+		if err := dbw.LoadUser(ctx, &user, authToken.UserID); err != nil {
 			respondErr(c, 401, "Authorization token is not valid.")
 			return
 		}
+		if !authToken.LastUsedAt.Valid || now.Sub(authToken.LastUsedAt.Time) > TokenTouchInterval {
+			dbw.TouchAuthToken(ctx, &authToken)
+		}
 		c.Set("user", &user)
+		c.Set("token", &authToken)
 		c.Next()
 	}
 }
@@ -90,138 +296,780 @@ type ImgResp struct {
 }
 
 type JobResp struct {
-	OK     bool      `json:"ok"`
-	PK     string    `json:"pk"`
-	Images []ImgResp `json:"images"`
+	OK         bool       `json:"ok"`
+	PK         string     `json:"pk"`
+	Kind       string     `json:"kind"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	Params     JobParams  `json:"params,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Images     []ImgResp  `json:"images"`
 }
 
-func (app *App) getApiImage(c *gin.Context) {
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Deletes finished job with its images. Jobs left unfinished by a restart
+// are failed or queued again by JobQueue.Recover, so they finish as well.
+func (app *App) deleteApiJob(c *gin.Context) {
+	var job Job
+	if !app.userJob(c, &job) {
+		return
+	}
+	if job.State == JobStateStarted {
+		respondErr(c, 409, "Job is not finished yet.")
+		return
+	}
+	ctx := c.Request.Context()
+	imgs, err := app.DBW.JobImages(ctx, job.ID)
+	if err != nil {
+		respondErr(c, 500, "Could not fetch images")
+		return
+	}
+	if err := app.DBW.DeleteJob(ctx, &job); err != nil {
+		respondErr(c, 500, "Could not delete job")
+		return
+	}
+	for _, img := range imgs {
+		removeImageFile(ctx, app.DBW, app.Storage, &img)
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// Image record without its location on disk
+type ImageMeta struct {
+	PK        string    `json:"pk"`
+	JobID     string    `json:"job_id"`
+	Kind      string    `json:"kind"`
+	MimeType  string    `json:"mime_type"`
+	Size      int64     `json:"size"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ImageMetaResp struct {
+	OK bool `json:"ok"`
+	ImageMeta
+}
+
+type ImageListResp struct {
+	OK     bool        `json:"ok"`
+	Images []ImageMeta `json:"images"`
+	// Cursor of the next page, empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+func newImageMeta(img *Image) ImageMeta {
+	meta := ImageMeta{
+		PK:       img.ID,
+		JobID:    img.JobID,
+		Kind:     img.Kind,
+		MimeType: img.MimeType,
+		Size:     img.Size,
+		Width:    img.Width,
+		Height:   img.Height,
+	}
+	if id, err := ulid.Parse(img.ID); err == nil {
+		meta.CreatedAt = ulid.Time(id.Time()).UTC()
+	}
+	return meta
+}
+
+// Loads image of the user responding with error if it fails
+func (app *App) userImage(c *gin.Context, img *Image) bool {
 	user, ok := c.MustGet("user").(*User)
 	if !ok {
 		respondErr(c, 401, "Not authorized")
-		return
+		return false
 	}
-	id := c.Param("id")
-	var img Image
-	if err := app.DBW.LoadImage(&img, id); err != nil {
+	if err := app.DBW.LoadImage(c.Request.Context(), img, c.Param("id")); err != nil {
 		if IsNotFound(err) {
 			respondErr(c, 404, "Could not find")
-			return
 		} else {
 			respondErr(c, 500, "Could not fetch")
-			return
 		}
+		return false
 	}
 	if user.ID != img.UserID {
 		respondErr(c, 403, "Not allowed")
+		return false
+	}
+	return true
+}
+
+func (app *App) getApiImageMeta(c *gin.Context) {
+	var img Image
+	if !app.userImage(c, &img) {
 		return
 	}
-	c.Header("Content-Type", img.MimeType)
-	c.File(img.Path)
+	c.JSON(200, &ImageMetaResp{OK: true, ImageMeta: newImageMeta(&img)})
 }
 
-func (app *App) getApiJob(c *gin.Context) {
+// Lists images of the user newest first, pass next from response as cursor to get the following page
+func (app *App) getApiImages(c *gin.Context) {
 	user, ok := c.MustGet("user").(*User)
 	if !ok {
 		respondErr(c, 401, "Not authorized")
 		return
 	}
-	id := c.Param("id")
-	var job Job
-	if err := app.DBW.LoadJob(&job, id); err != nil {
+	limit, err := pageSize(c)
+	if err != nil {
+		respondErr(c, 400, err.Error())
+		return
+	}
+	imgs, err := app.DBW.ListImages(c.Request.Context(), ImageFilter{
+		UserID: user.ID,
+		JobID:  c.Query("job"),
+		Kind:   c.Query("kind"),
+		Before: c.Query("cursor"),
+		Limit:  limit + 1,
+	})
+	if err != nil {
+		respondErr(c, 500, "Could not fetch images")
+		return
+	}
+	resp := ImageListResp{OK: true, Images: []ImageMeta{}}
+	if len(imgs) > limit {
+		imgs = imgs[:limit]
+		resp.Next = imgs[limit-1].ID
+	}
+	for i := range imgs {
+		resp.Images = append(resp.Images, newImageMeta(&imgs[i]))
+	}
+	c.JSON(200, &resp)
+}
+
+func (app *App) deleteApiImage(c *gin.Context) {
+	var img Image
+	if !app.userImage(c, &img) {
+		return
+	}
+	if err := app.DBW.DeleteImage(c.Request.Context(), &img); err != nil {
+		respondErr(c, 500, "Could not delete image")
+		return
+	}
+	removeImageFile(c.Request.Context(), app.DBW, app.Storage, &img)
+	c.JSON(200, gin.H{"ok": true})
+}
+
+func (app *App) getApiImage(c *gin.Context) {
+	var img Image
+	if !app.userImage(c, &img) {
+		return
+	}
+	file, err := app.Storage.Open(c.Request.Context(), img.Path)
+	if err != nil {
+		if IsNotFound(err) {
+			respondErr(c, 404, "Could not find file")
+		} else {
+			respondErr(c, 500, "Could not fetch file")
+		}
+		return
+	}
+	defer file.Close()
+	c.DataFromReader(200, img.Size, img.MimeType, file, map[string]string{"X-Content-Type-Options": "nosniff"})
+}
+
+// Loads job of the user responding with error if it fails
+func (app *App) userJob(c *gin.Context, job *Job) bool {
+	user, ok := c.MustGet("user").(*User)
+	if !ok {
+		respondErr(c, 401, "Not authorized")
+		return false
+	}
+	if err := app.DBW.LoadJob(c.Request.Context(), job, c.Param("id")); err != nil {
 		if IsNotFound(err) {
 			respondErr(c, 404, "Could not find")
-			return
 		} else {
 			respondErr(c, 500, "Could not fetch job")
-			return
 		}
+		return false
 	}
 	if user.ID != job.UserID {
 		respondErr(c, 403, "Not allowed")
+		return false
+	}
+	return true
+}
+
+func (app *App) getApiJob(c *gin.Context) {
+	var job Job
+	if !app.userJob(c, &job) {
 		return
 	}
-	resp := JobResp{
-		OK: true,
-		PK: job.ID,
+	imageIDs, err := app.DBW.JobImageIDs(c.Request.Context(), []string{job.ID})
+	if err != nil {
+		respondErr(c, 500, "Could not fetch images")
+		return
 	}
+	resp := newJobResp(&job, imageIDs[job.ID])
+	c.JSON(200, &resp)
+}
+
+// Interval of comments keeping idle event streams open
+const EventKeepAlive = 15 * time.Second
+
+// How often the job is loaded for stream which fell behind its events
+const EventPollInterval = time.Second
+
+// Sends current state of the job, returns false if the stream should end
+func (app *App) sendJobState(c *gin.Context, job *Job) bool {
+	ctx := c.Request.Context()
 	var imgs []Image
-	err := app.DBW.Select(&imgs, "select * from images where job_id=?", job.ID)
+	if job.State == JobStateDone {
+		var err error
+		if imgs, err = app.DBW.JobImages(ctx, job.ID); err != nil {
+			return false
+		}
+	}
+	events := jobStateEvents(job, imgs)
+	for _, e := range events {
+		c.SSEvent(e.Type, e)
+	}
+	return !events[len(events)-1].Final()
+}
+
+// Streams job events as server-sent events until the job is finished. Image events
+// come as outputs are stored, ids of saved images are in the done event. Stream of
+// job finished already tells its images with ids followed by the done event.
+func (app *App) getApiJobEvents(c *gin.Context) {
+	var job Job
+	if !app.userJob(c, &job) {
+		return
+	}
+	events, unsubscribe := app.Queue.Events.Subscribe(job.ID)
+	defer unsubscribe()
+	ctx := c.Request.Context()
+	// job may change before subscription, so it is loaded again
+	if err := app.DBW.LoadJob(ctx, &job, job.ID); err != nil {
+		respondErr(c, 500, "Could not fetch job")
+		return
+	}
+	sent := jobStateEvents(&job, nil)[0].Type
+	if !app.sendJobState(c, &job) {
+		return
+	}
+	// sends state of the job loaded again if it changed
+	refresh := func() bool {
+		if err := app.DBW.LoadJob(ctx, &job, job.ID); err != nil {
+			return false
+		}
+		state := jobStateEvents(&job, nil)[0].Type
+		if state == sent {
+			return true
+		}
+		sent = state
+		return app.sendJobState(c, &job)
+	}
+	keepAlive := time.NewTicker(EventKeepAlive)
+	defer keepAlive.Stop()
+	poll := time.NewTicker(EventPollInterval)
+	defer poll.Stop()
+	// receives ticks only after events stop coming
+	var polls <-chan time.Time
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				// subscriber fell behind, the rest is told by the database
+				events = nil
+				polls = poll.C
+				return refresh()
+			}
+			if (e.Type == JobEventQueued || e.Type == JobEventStarted) && e.Type == sent {
+				return true
+			}
+			if e.Type == JobEventQueued || e.Type == JobEventStarted {
+				sent = e.Type
+			}
+			c.SSEvent(e.Type, e)
+			return !e.Final()
+		case <-polls:
+			return refresh()
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+func newJobResp(job *Job, imageIDs []string) JobResp {
+	resp := JobResp{
+		OK:         true,
+		PK:         job.ID,
+		Kind:       job.Kind,
+		State:      job.StateName(),
+		Error:      job.Error,
+		Params:     job.Params,
+		CreatedAt:  job.CreatedAt,
+		StartedAt:  nullTimePtr(job.StartedAt),
+		FinishedAt: nullTimePtr(job.FinishedAt),
+	}
+	for _, id := range imageIDs {
+		resp.Images = append(resp.Images, ImgResp{PK: id})
+	}
+	return resp
+}
+
+type JobListResp struct {
+	OK   bool      `json:"ok"`
+	Jobs []JobResp `json:"jobs"`
+	// Cursor of the next page, empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// Parses limit query parameter falling back to DefaultPageSize
+func pageSize(c *gin.Context) (int, error) {
+	value := c.Query("limit")
+	if value == "" {
+		return DefaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > MaxPageSize {
+		return 0, fmt.Errorf("Limit should be a number from 1 to %d.", MaxPageSize)
+	}
+	return limit, nil
+}
+
+func parseJobState(name string) (int64, bool) {
+	for state, n := range JobStateNames {
+		if n == name {
+			return state, true
+		}
+	}
+	return 0, false
+}
+
+// Lists jobs of the user newest first, pass next from response as cursor to get the following page
+func (app *App) getApiJobs(c *gin.Context) {
+	user, ok := c.MustGet("user").(*User)
+	if !ok {
+		respondErr(c, 401, "Not authorized")
+		return
+	}
+	limit, err := pageSize(c)
+	if err != nil {
+		respondErr(c, 400, err.Error())
+		return
+	}
+	filter := JobFilter{
+		UserID: user.ID,
+		Kind:   c.Query("kind"),
+		Before: c.Query("cursor"),
+		Limit:  limit + 1,
+	}
+	if name := c.Query("state"); name != "" {
+		state, ok := parseJobState(name)
+		if !ok {
+			respondErr(c, 400, "Wrong job state.")
+			return
+		}
+		filter.State = &state
+	}
+	ctx := c.Request.Context()
+	jobs, err := app.DBW.ListJobs(ctx, filter)
+	if err != nil {
+		respondErr(c, 500, "Could not fetch jobs")
+		return
+	}
+	resp := JobListResp{OK: true, Jobs: []JobResp{}}
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+		resp.Next = jobs[limit-1].ID
+	}
+	jobIDs := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		jobIDs = append(jobIDs, job.ID)
+	}
+	imageIDs, err := app.DBW.JobImageIDs(ctx, jobIDs)
 	if err != nil {
 		respondErr(c, 500, "Could not fetch images")
 		return
 	}
-	for _, img := range imgs {
-		resp.Images = append(resp.Images, ImgResp{PK: img.ID})
+	for i := range jobs {
+		resp.Jobs = append(resp.Jobs, newJobResp(&jobs[i], imageIDs[jobs[i].ID]))
 	}
-
 	c.JSON(200, &resp)
 }
 
+// Upload rejected while staging, errCode is empty for errors without one
+type uploadError struct {
+	status  int
+	errCode string
+	msg     string
+}
+
+func respondUploadErr(c *gin.Context, err *uploadError, prefix string) {
+	if err.errCode == "" {
+		respondErr(c, err.status, prefix+err.msg)
+	} else {
+		respondErrCode(c, err.status, err.errCode, prefix+err.msg)
+	}
+}
+
+func respondBodyTooLarge(c *gin.Context, limit int64) {
+	respondErrCode(c, 413, ErrCodeBodyTooLarge, fmt.Sprintf("Request body is larger than %d bytes.", limit))
+}
+
+// Caps request body at limit, returns nil after responding if declared length exceeds it
+func limitRequestBody(c *gin.Context, limit int64) *limitedBody {
+	if c.Request.ContentLength > limit {
+		respondBodyTooLarge(c, limit)
+		return nil
+	}
+	body := newLimitedBody(c.Request.Body, limit)
+	c.Request.Body = body
+	return body
+}
+
+// Checks file of the job and stages it for processing
+func (app *App) stageJobInput(job *Job, in *jobInput) (*Upload, *uploadError) {
+	if in.Size > app.MAX_FILE_SIZE {
+		return nil, &uploadError{413, ErrCodeFileTooLarge, fmt.Sprintf("File is larger than %d bytes.", app.MAX_FILE_SIZE)}
+	}
+	format, content, err := DetectImageFormat(in.Body, in.MimeType)
+	if err != nil {
+		if IsUnsupportedFormat(err) {
+			return nil, &uploadError{415, "", err.Error()}
+		}
+		return nil, &uploadError{400, "", err.Error()}
+	}
+	fileName := in.FileName
+	if fileName == "" {
+		fileName = "upload"
+	}
+	fileName = format.FixFileName(fileName)
+	upload, err := StageUpload(job, app.MEDIA_ROOT, fileName, format.MimeType, content)
+	if err != nil {
+		return nil, &uploadError{500, "", "Could not store file."}
+	}
+	bounds, err := checkUploadPixels(upload, app.MAX_PIXELS)
+	if err == nil && !bounds.Empty() {
+		// outputs size follows from the size of the upload now
+		proc, _ := LookupProcessor(job.Kind)
+		err = checkOutputPixels(proc, job.Params, bounds, app.MAX_PIXELS)
+	}
+	if err != nil {
+		upload.Remove()
+		if _, ok := err.(TooManyPixelsError); ok {
+			return nil, &uploadError{422, ErrCodeTooManyPixels, err.Error()}
+		}
+		return nil, &uploadError{500, "", "Could not read file."}
+	}
+	return upload, nil
+}
+
+// Checks parameters of the job kind, output parameters and that outputs
+// they ask for can not exceed MAX_PIXELS, as far as parameters alone tell
+func (app *App) validateJobParams(kind string, params map[string]string) *uploadError {
+	proc, _ := LookupProcessor(kind)
+	if err := proc.Validate(params); err != nil {
+		return &uploadError{400, "", err.Error()}
+	}
+	if _, err := parseOutputParams(params); err != nil {
+		return &uploadError{400, "", err.Error()}
+	}
+	if err := checkOutputPixels(proc, params, image.Rectangle{}, app.MAX_PIXELS); err != nil {
+		if _, ok := err.(TooManyPixelsError); ok {
+			return &uploadError{422, ErrCodeTooManyPixels, err.Error()}
+		}
+		return &uploadError{400, "", err.Error()}
+	}
+	return nil
+}
+
+// Accepts job as multipart form or JSON with base64 encoded file
 func (app *App) postApiJob(c *gin.Context) {
 	user, ok := c.MustGet("user").(*User)
 	if !ok {
 		respondErr(c, 401, "Not authorized")
 		return
 	}
-	file, err := c.FormFile("file")
+	body := limitRequestBody(c, app.MAX_BODY_SIZE)
+	if body == nil {
+		return
+	}
+	var in *jobInput
+	var err error
+	if c.ContentType() == gin.MIMEJSON {
+		in, err = jobInputFromJSON(c)
+	} else {
+		in, err = jobInputFromForm(c)
+	}
+	if body.exceeded {
+		respondBodyTooLarge(c, app.MAX_BODY_SIZE)
+		return
+	}
 	if err != nil {
-		respondErr(c, 400, "No file is received.")
+		respondErr(c, 400, err.Error())
 		return
 	}
-	//	fmt.Printf("headers are %#v", file.Header)
-	kind := c.PostForm("kind")
-	job, err := NewJob(user.ID, kind)
+	defer in.Body.Close()
+	job, err := NewJob(user.ID, in.Kind)
 	if err != nil {
 		respondErr(c, 400, err.Error())
 		return
 	}
-	if err := app.DBW.SaveNewJob(job); err != nil {
-		println(err.Error())
+	job.Params = in.Params
+	job.Instance = app.INSTANCE
+	if verr := app.validateJobParams(job.Kind, job.Params); verr != nil {
+		respondUploadErr(c, verr, "")
+		return
+	}
+	upload, uerr := app.stageJobInput(job, in)
+	if uerr != nil {
+		respondUploadErr(c, uerr, "")
+		return
+	}
+	if err := app.DBW.SaveNewJob(c.Request.Context(), job); err != nil {
+		upload.Remove()
 		respondErr(c, 500, "Could not save job.")
 		return
 	}
+	if err := app.Queue.Enqueue(job, upload); err != nil {
+		upload.Remove()
+		job.Finish(err)
+		app.DBW.SaveJob(c.Request.Context(), job)
+		respondErr(c, 503, err.Error())
+		return
+	}
+	c.JSON(202, gin.H{
+		"ok":     true,
+		"job_id": job.ID,
+	})
+}
 
-	switch kind {
-	case JOB_ORIG:
-		if err := performJobOrig(app.DBW, job, app.MEDIA_ROOT, file); err != nil {
-			respondErr(c, 400, err.Error())
-			return
+// Accepts files as multipart form or JSON array of base64 encoded files
+// and makes a job of the same kind for each of them
+func (app *App) postApiBatch(c *gin.Context) {
+	user, ok := c.MustGet("user").(*User)
+	if !ok {
+		respondErr(c, 401, "Not authorized")
+		return
+	}
+	body := limitRequestBody(c, app.MAX_BATCH_BODY_SIZE)
+	if body == nil {
+		return
+	}
+	var inputs []*jobInput
+	var err error
+	if c.ContentType() == gin.MIMEJSON {
+		inputs, err = batchInputsFromJSON(c, app.MAX_BATCH_FILES)
+	} else {
+		inputs, err = batchInputsFromForm(c, app.MAX_BATCH_FILES)
+	}
+	if body.exceeded {
+		respondBodyTooLarge(c, app.MAX_BATCH_BODY_SIZE)
+		return
+	}
+	if err != nil {
+		respondErr(c, 400, err.Error())
+		return
+	}
+	defer closeInputs(inputs)
+	batch, err := NewBatch(user.ID, inputs[0].Kind)
+	if err != nil {
+		respondErr(c, 400, err.Error())
+		return
+	}
+	batch.Params = inputs[0].Params
+	if verr := app.validateJobParams(batch.Kind, batch.Params); verr != nil {
+		respondUploadErr(c, verr, "")
+		return
+	}
+	// whole batch is queued or rejected before anything is staged
+	reservation, err := app.Queue.Reserve(len(inputs))
+	if err != nil {
+		respondErr(c, 503, err.Error())
+		return
+	}
+	defer reservation.Release()
+	jobs := make([]*Job, 0, len(inputs))
+	uploads := make([]*Upload, 0, len(inputs))
+	removeUploads := func() {
+		for _, upload := range uploads {
+			upload.Remove()
 		}
-	case JOB_SQUARE_ORIG:
-		if err := performJobSquareOrig(app.DBW, job, app.MEDIA_ROOT, file); err != nil {
-			respondErr(c, 400, err.Error())
+	}
+	for i, in := range inputs {
+		job, err := batch.NewJob()
+		if err != nil {
+			removeUploads()
+			respondErr(c, 500, "Could not create job.")
 			return
 		}
-	case JOB_SQUARE_SMALL:
-		if err := performJobSquareSmall(app.DBW, job, app.MEDIA_ROOT, file); err != nil {
-			respondErr(c, 400, err.Error())
+		job.Instance = app.INSTANCE
+		if err := in.load(); err != nil {
+			removeUploads()
+			respondErr(c, 400, fmt.Sprintf("File %d: %s", i, err.Error()))
 			return
 		}
-	case JOB_ALL_THREE:
-		if err := performJobAllThree(app.DBW, job, app.MEDIA_ROOT, file); err != nil {
-			respondErr(c, 400, err.Error())
+		upload, uerr := app.stageJobInput(job, in)
+		in.close()
+		if uerr != nil {
+			removeUploads()
+			respondUploadErr(c, uerr, fmt.Sprintf("File %d: ", i))
 			return
 		}
-	default:
-		respondErr(c, 400, "Not valid job kind.")
+		jobs = append(jobs, job)
+		uploads = append(uploads, upload)
+	}
+	ctx := c.Request.Context()
+	if err := app.DBW.SaveNewBatch(ctx, batch, jobs); err != nil {
+		removeUploads()
+		respondErr(c, 500, "Could not save batch.")
 		return
 	}
-
-	c.JSON(200, gin.H{
-		"ok":     true,
-		"job_id": job.ID,
+	// jobs fail only if the queue is stopped meanwhile
+	jobIDs := make([]string, 0, len(jobs))
+	for i, job := range jobs {
+		if err := reservation.Enqueue(job, uploads[i]); err != nil {
+			uploads[i].Remove()
+			job.Finish(err)
+			app.DBW.SaveJob(ctx, job)
+		}
+		jobIDs = append(jobIDs, job.ID)
+	}
+	c.JSON(202, gin.H{
+		"ok":       true,
+		"batch_id": batch.ID,
+		"job_ids":  jobIDs,
 	})
 }
 
+type BatchResp struct {
+	OK     bool      `json:"ok"`
+	PK     string    `json:"pk"`
+	Kind   string    `json:"kind"`
+	Params JobParams `json:"params,omitempty"`
+	// Started while any job runs, failed if any job failed, done otherwise
+	State     string    `json:"state"`
+	Total     int       `json:"total"`
+	Started   int       `json:"started"`
+	Done      int       `json:"done"`
+	Failed    int       `json:"failed"`
+	CreatedAt time.Time `json:"created_at"`
+	Jobs      []JobResp `json:"jobs"`
+	// Images of all jobs in order of jobs
+	Images []ImgResp `json:"images"`
+}
+
+func (app *App) userBatch(c *gin.Context, batch *Batch) bool {
+	user, ok := c.MustGet("user").(*User)
+	if !ok {
+		respondErr(c, 401, "Not authorized")
+		return false
+	}
+	if err := app.DBW.LoadBatch(c.Request.Context(), batch, c.Param("id")); err != nil {
+		if IsNotFound(err) {
+			respondErr(c, 404, "Could not find")
+		} else {
+			respondErr(c, 500, "Could not fetch batch")
+		}
+		return false
+	}
+	if user.ID != batch.UserID {
+		respondErr(c, 403, "Not allowed")
+		return false
+	}
+	return true
+}
+
+func (app *App) getApiBatch(c *gin.Context) {
+	var batch Batch
+	if !app.userBatch(c, &batch) {
+		return
+	}
+	ctx := c.Request.Context()
+	jobs, err := app.DBW.BatchJobs(ctx, batch.ID)
+	if err != nil {
+		respondErr(c, 500, "Could not fetch jobs")
+		return
+	}
+	jobIDs := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		jobIDs = append(jobIDs, job.ID)
+	}
+	imageIDs, err := app.DBW.JobImageIDs(ctx, jobIDs)
+	if err != nil {
+		respondErr(c, 500, "Could not fetch images")
+		return
+	}
+	resp := BatchResp{
+		OK:        true,
+		PK:        batch.ID,
+		Kind:      batch.Kind,
+		Params:    batch.Params,
+		Total:     len(jobs),
+		CreatedAt: batch.CreatedAt,
+		Jobs:      []JobResp{},
+		Images:    []ImgResp{},
+	}
+	for i := range jobs {
+		jobResp := newJobResp(&jobs[i], imageIDs[jobs[i].ID])
+		resp.Jobs = append(resp.Jobs, jobResp)
+		resp.Images = append(resp.Images, jobResp.Images...)
+		switch jobs[i].State {
+		case JobStateStarted:
+			resp.Started++
+		case JobStateDone:
+			resp.Done++
+		case JobStateFailed:
+			resp.Failed++
+		}
+	}
+	switch {
+	case resp.Started > 0:
+		resp.State = JobStateNames[JobStateStarted]
+	case resp.Failed > 0:
+		resp.State = JobStateNames[JobStateFailed]
+	default:
+		resp.State = JobStateNames[JobStateDone]
+	}
+	c.JSON(200, &resp)
+}
+
 func SetupRouter(r *gin.Engine, dbw *DBWorker, mediaRoot string) *gin.Engine {
-	if _, err := os.Stat(mediaRoot); os.IsNotExist(err) {
-		log.Fatalf("%s is not accessible", mediaRoot)
+	return NewApp(dbw, mediaRoot).SetupRouter(r)
+}
+
+func (app *App) SetupRouter(r *gin.Engine) *gin.Engine {
+	if _, err := os.Stat(app.MEDIA_ROOT); os.IsNotExist(err) {
+		log.Fatalf("%s is not accessible", app.MEDIA_ROOT)
+	}
+	if err := os.MkdirAll(StagingDir(app.MEDIA_ROOT), os.ModePerm); err != nil {
+		log.Fatal(err)
 	}
-	app := &App{dbw, mediaRoot}
+	app.Queue.Start()
+	auth := AuthMiddleware(app.DBW, app.TOKEN_SECRET)
 	r.POST("/api/token/", app.postApiToken)
-	r.POST("/api/job/", AuthMiddleware(dbw), app.postApiJob)
-	r.GET("/api/job/:id/", AuthMiddleware(dbw), app.getApiJob)
-	r.GET("/api/image/:id/", AuthMiddleware(dbw), app.getApiImage)
+	r.POST("/api/register/", app.postApiRegister)
+	r.POST("/api/logout/", auth, app.postApiLogout)
+	r.POST("/api/token/rotate/", auth, app.postApiTokenRotate)
+	r.POST("/api/job/", auth, app.postApiJob)
+	r.GET("/api/job/:id/", auth, app.getApiJob)
+	r.GET("/api/job/:id/events/", auth, app.getApiJobEvents)
+	r.DELETE("/api/job/:id/", auth, app.deleteApiJob)
+	r.GET("/api/jobs/", auth, app.getApiJobs)
+	r.POST("/api/batch/", auth, app.postApiBatch)
+	r.GET("/api/batch/:id/", auth, app.getApiBatch)
+	r.GET("/api/image/:id/", auth, app.getApiImage)
+	r.DELETE("/api/image/:id/", auth, app.deleteApiImage)
+	r.GET("/api/image/:id/meta/", auth, app.getApiImageMeta)
+	r.GET("/api/images/", auth, app.getApiImages)
 	return r
 }
@@ -1,31 +1,69 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image"
 	"io"
+	"io/ioutil"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/textproto"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func createTestUser(name, password string, dbw *DBWorker) (*User, error) {
+// Key of token hashes used by test routers
+var testTokenSecret = []byte("test-token-secret")
+
+// Saves new user and returns it with the key of a token issued for it
+func createTestUser(name, password string, dbw *DBWorker) (*User, string) {
+	ctx := context.Background()
 	user, _ := NewUser(name, password)
-	return user, dbw.SaveNewUser(user)
+	if err := dbw.SaveNewUser(ctx, user); err != nil {
+		panic(err)
+	}
+	token, _ := NewAuthToken(user.ID, 0, testTokenSecret)
+	if err := dbw.SaveNewAuthToken(ctx, token); err != nil {
+		panic(err)
+	}
+	return user, token.Key
+}
+
+// Waits until worker finishes the job and returns it
+func waitJob(t *testing.T, dbw *DBWorker, jobID string) Job {
+	var job Job
+	for i := 0; i < 500; i++ {
+		require.Nil(t, dbw.LoadJob(context.Background(), &job, jobID))
+		if job.State != JobStateStarted {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s is not finished", jobID)
+	return job
 }
 
 func setupTestRouter(dbw *DBWorker, mediaRoot string) *gin.Engine {
-	r := gin.New()
-	return SetupRouter(r, dbw, mediaRoot)
+	app := NewApp(dbw, mediaRoot)
+	app.TOKEN_SECRET = testTokenSecret
+	return app.SetupRouter(gin.New())
 }
 
 type Resp struct {
@@ -33,6 +71,7 @@ type Resp struct {
 	Error string `json:"error,omitempty"`
 	Token string `json:"token,omitempty"`
 	JobID string `json:"job_id,omitempty"`
+	Code  string `json:"code,omitempty"`
 }
 
 func NewJsonRequest(path string, data map[string]string) (*http.Request, error) {
@@ -52,7 +91,8 @@ func TestApiGetToken(t *testing.T) {
 	dbw, err := testDBWorker()
 	defer removeWorker(dbw)
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.createTables())
+	assert.Nil(t, dbw.CreateTables())
+	os.MkdirAll("/tmp/foo", os.ModePerm)
 	router := setupTestRouter(dbw, "/tmp/foo")
 	createTestUser("foo", "bar", dbw)
 	w := httptest.NewRecorder()
@@ -113,12 +153,148 @@ func TestApiGetToken(t *testing.T) {
 	assert.True(t, len(resp.Token) > 10)
 }
 
+// Sends authorized request and returns response code and body
+func authRequest(router *gin.Engine, method, path, token string) (int, Resp) {
+	var resp Resp
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Add("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func TestApiTokenLifecycle(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	createTestUser("foo", "bar", dbw)
+	login := func() string {
+		var resp Resp
+		req, _ := NewJsonRequest("/api/token/", map[string]string{"username": "foo", "password": "bar"})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+		require.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp.Token
+	}
+	token1 := login()
+	token2 := login()
+	assert.NotEqual(t, token1, token2)
+
+	code, resp := authRequest(router, "POST", "/api/token/rotate/", token1)
+	require.Equal(t, 200, code)
+	token3 := resp.Token
+	assert.NotEqual(t, token1, token3)
+	code, resp = authRequest(router, "POST", "/api/logout/", token1)
+	assert.Equal(t, 401, code)
+	assert.Equal(t, "Authorization token is revoked.", resp.Error)
+
+	code, _ = authRequest(router, "POST", "/api/logout/", token3)
+	assert.Equal(t, 200, code)
+	code, _ = authRequest(router, "POST", "/api/logout/", token3)
+	assert.Equal(t, 401, code)
+	// other sessions are not affected
+	code, _ = authRequest(router, "POST", "/api/token/rotate/", token2)
+	assert.Equal(t, 200, code)
+
+	var user User
+	require.Nil(t, dbw.LoadUserByName(context.Background(), &user, "foo"))
+	expired, _ := NewAuthToken(user.ID, time.Nanosecond, testTokenSecret)
+	require.Nil(t, dbw.SaveNewAuthToken(context.Background(), expired))
+	code, resp = authRequest(router, "POST", "/api/logout/", expired.Key)
+	assert.Equal(t, 401, code)
+	assert.Equal(t, "Authorization token has expired.", resp.Error)
+}
+
+func postRegister(router *gin.Engine, data map[string]string) (int, Resp) {
+	var resp Resp
+	req, _ := NewJsonRequest("/api/register/", data)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	json.NewDecoder(w.Body).Decode(&resp)
+	return w.Code, resp
+}
+
+func TestApiRegister(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	app := NewApp(dbw, "/tmp/foo")
+	app.INVITE_CODE = "111111"
+	app.TOKEN_SECRET = testTokenSecret
+	router := app.SetupRouter(gin.New())
+	createTestUser("foo", "bar", dbw)
+
+	code, resp := postRegister(router, map[string]string{"username": "spam", "code": "111111"})
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "Missing username or password.", resp.Error)
+
+	code, resp = postRegister(router, map[string]string{"username": "spam", "password": "short", "code": "111111"})
+	assert.Equal(t, 400, code)
+	assert.Contains(t, resp.Error, "at least")
+
+	code, resp = postRegister(router, map[string]string{"username": "spam egg", "password": "eggeggegg", "code": "111111"})
+	assert.Equal(t, 400, code)
+	assert.False(t, resp.OK)
+
+	code, resp = postRegister(router, map[string]string{"username": "spam", "password": "eggeggegg", "code": "dummy"})
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "Invitation code wrong or missing.", resp.Error)
+
+	code, resp = postRegister(router, map[string]string{"username": "foo", "password": "eggeggegg", "code": "111111"})
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "Username already exists.", resp.Error)
+
+	code, resp = postRegister(router, map[string]string{"username": "spam", "password": "eggeggegg", "code": "111111"})
+	require.Equal(t, 200, code)
+	assert.True(t, resp.OK)
+	var user User
+	require.Nil(t, dbw.LoadUserByName(context.Background(), &user, "spam"))
+	var token AuthToken
+	require.Nil(t, dbw.LoadAuthToken(context.Background(), &token, resp.Token, testTokenSecret))
+	assert.Equal(t, user.ID, token.UserID)
+	assert.True(t, token.ExpiresAt.Valid)
+	assert.True(t, user.IsPasswdValid("eggeggegg"))
+}
+
+func TestApiRegisterSingleUseCode(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	invite, _ := NewInviteCode()
+	require.Nil(t, dbw.SaveNewInviteCode(context.Background(), invite))
+
+	code, resp := postRegister(router, map[string]string{"username": "spam", "password": "eggeggegg", "code": invite.Code})
+	require.Equal(t, 200, code)
+	assert.True(t, len(resp.Token) > 10)
+	var user User
+	require.Nil(t, dbw.LoadUserByName(context.Background(), &user, "spam"))
+	var loaded InviteCode
+	require.Nil(t, dbw.LoadInviteCode(context.Background(), &loaded, invite.Code))
+	assert.Equal(t, user.ID, loaded.UsedBy.String)
+	assert.True(t, loaded.UsedAt.Valid)
+
+	code, resp = postRegister(router, map[string]string{"username": "egg", "password": "eggeggegg", "code": invite.Code})
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "Invitation code wrong or missing.", resp.Error)
+	assert.True(t, IsNotFound(dbw.LoadUserByName(context.Background(), &user, "egg")))
+}
+
 func TestApiJobPostOrig(t *testing.T) {
 	dbw, err := testDBWorker()
 	defer removeWorker(dbw)
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.createTables())
-	user, _ := createTestUser("foo", "bar", dbw)
+	assert.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
 	os.MkdirAll("/tmp/foo", os.ModePerm)
 	defer os.Remove("/tmp/foo")
 	router := setupTestRouter(dbw, "/tmp/foo")
@@ -127,19 +303,19 @@ func TestApiJobPostOrig(t *testing.T) {
 	require.Nil(t, err)
 	req, _ := http.NewRequest("POST", "/api/job/", buf)
 	req.Header.Add("Content-Type", contentType)
-	req.Header.Add("Authorization", "Token "+user.Token)
+	req.Header.Add("Authorization", "Token "+token)
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 202, w.Code)
 	decoder := json.NewDecoder(w.Body)
 	var resp Resp
 	err = decoder.Decode(&resp)
 	require.Nil(t, err)
 	require.True(t, resp.OK)
 	assert.True(t, resp.JobID != "")
-	var job Job
-	assert.Nil(t, dbw.LoadJob(&job, resp.JobID))
+	job := waitJob(t, dbw, resp.JobID)
+	assert.Equal(t, int64(JobStateDone), job.State)
 	var imgs []Image
 	assert.Nil(t, dbw.Select(&imgs, "select * from images where job_id=?", job.ID))
 	assert.Equal(t, 1, len(imgs))
@@ -147,7 +323,7 @@ func TestApiJobPostOrig(t *testing.T) {
 	assert.Equal(t, int64(167314), img.Size)
 	assert.Equal(t, 1236, img.Width)
 	assert.Equal(t, 624, img.Height)
-	stat, err := os.Stat(img.Path)
+	stat, err := os.Stat(filepath.Join("/tmp/foo", img.Path))
 	assert.Nil(t, err)
 	assert.Equal(t, img.Size, stat.Size())
 }
@@ -156,8 +332,8 @@ func TestApiJobPostSquareOrig(t *testing.T) {
 	dbw, err := testDBWorker()
 	defer removeWorker(dbw)
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.createTables())
-	user, _ := createTestUser("foo", "bar", dbw)
+	assert.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
 	os.MkdirAll("/tmp/foo", os.ModePerm)
 	defer os.Remove("/tmp/foo")
 	router := setupTestRouter(dbw, "/tmp/foo")
@@ -166,19 +342,19 @@ func TestApiJobPostSquareOrig(t *testing.T) {
 	require.Nil(t, err)
 	req, _ := http.NewRequest("POST", "/api/job/", buf)
 	req.Header.Add("Content-Type", contentType)
-	req.Header.Add("Authorization", "Token "+user.Token)
+	req.Header.Add("Authorization", "Token "+token)
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 202, w.Code)
 	decoder := json.NewDecoder(w.Body)
 	var resp Resp
 	err = decoder.Decode(&resp)
 	require.Nil(t, err)
 	require.True(t, resp.OK)
 	assert.True(t, resp.JobID != "")
-	var job Job
-	assert.Nil(t, dbw.LoadJob(&job, resp.JobID))
+	job := waitJob(t, dbw, resp.JobID)
+	assert.Equal(t, int64(JobStateDone), job.State)
 	var imgs []Image
 	assert.Nil(t, dbw.Select(&imgs, "select * from images where job_id=?", job.ID))
 	require.Equal(t, 1, len(imgs))
@@ -186,7 +362,7 @@ func TestApiJobPostSquareOrig(t *testing.T) {
 	assert.NotEqual(t, int64(167314), img.Size)
 	assert.Equal(t, 1236, img.Width)
 	assert.Equal(t, 1236, img.Height)
-	stat, err := os.Stat(img.Path)
+	stat, err := os.Stat(filepath.Join("/tmp/foo", img.Path))
 	assert.Nil(t, err)
 	assert.Equal(t, img.Size, stat.Size())
 }
@@ -195,8 +371,8 @@ func TestApiJobPostSquareSmall(t *testing.T) {
 	dbw, err := testDBWorker()
 	defer removeWorker(dbw)
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.createTables())
-	user, _ := createTestUser("foo", "bar", dbw)
+	assert.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
 	os.MkdirAll("/tmp/foo", os.ModePerm)
 	defer os.Remove("/tmp/foo")
 	router := setupTestRouter(dbw, "/tmp/foo")
@@ -205,19 +381,19 @@ func TestApiJobPostSquareSmall(t *testing.T) {
 	require.Nil(t, err)
 	req, _ := http.NewRequest("POST", "/api/job/", buf)
 	req.Header.Add("Content-Type", contentType)
-	req.Header.Add("Authorization", "Token "+user.Token)
+	req.Header.Add("Authorization", "Token "+token)
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 202, w.Code)
 	decoder := json.NewDecoder(w.Body)
 	var resp Resp
 	err = decoder.Decode(&resp)
 	require.Nil(t, err)
 	require.True(t, resp.OK)
 	assert.True(t, resp.JobID != "")
-	var job Job
-	assert.Nil(t, dbw.LoadJob(&job, resp.JobID))
+	job := waitJob(t, dbw, resp.JobID)
+	assert.Equal(t, int64(JobStateDone), job.State)
 	var imgs []Image
 	assert.Nil(t, dbw.Select(&imgs, "select * from images where job_id=?", job.ID))
 	require.Equal(t, 1, len(imgs))
@@ -225,7 +401,7 @@ func TestApiJobPostSquareSmall(t *testing.T) {
 	assert.NotEqual(t, int64(167314), img.Size)
 	assert.Equal(t, 256, img.Width)
 	assert.Equal(t, 256, img.Height)
-	stat, err := os.Stat(img.Path)
+	stat, err := os.Stat(filepath.Join("/tmp/foo", img.Path))
 	assert.Nil(t, err)
 	assert.Equal(t, img.Size, stat.Size())
 }
@@ -234,8 +410,8 @@ func TestApiJobPostAllThree(t *testing.T) {
 	dbw, err := testDBWorker()
 	defer removeWorker(dbw)
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.createTables())
-	user, _ := createTestUser("foo", "bar", dbw)
+	assert.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
 	os.MkdirAll("/tmp/foo", os.ModePerm)
 	defer os.Remove("/tmp/foo")
 	router := setupTestRouter(dbw, "/tmp/foo")
@@ -244,36 +420,753 @@ func TestApiJobPostAllThree(t *testing.T) {
 	require.Nil(t, err)
 	req, _ := http.NewRequest("POST", "/api/job/", buf)
 	req.Header.Add("Content-Type", contentType)
-	req.Header.Add("Authorization", "Token "+user.Token)
+	req.Header.Add("Authorization", "Token "+token)
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
-	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 202, w.Code)
 	decoder := json.NewDecoder(w.Body)
 	var resp Resp
 	err = decoder.Decode(&resp)
 	require.Nil(t, err)
 	require.True(t, resp.OK)
 	assert.True(t, resp.JobID != "")
-	var job Job
-	assert.Nil(t, dbw.LoadJob(&job, resp.JobID))
+	job := waitJob(t, dbw, resp.JobID)
+	assert.Equal(t, int64(JobStateDone), job.State)
+	var imgs []Image
+	assert.Nil(t, dbw.Select(&imgs, "select * from images where job_id=? order by id", job.ID))
+	require.Equal(t, 3, len(imgs))
+	assert.Equal(t, JOB_ORIG, imgs[0].Kind)
+	assert.Equal(t, JOB_SQUARE_ORIG, imgs[1].Kind)
+	assert.Equal(t, JOB_SQUARE_SMALL, imgs[2].Kind)
+}
+
+func TestApiJobPostCustomKind(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+
+	buf, contentType, err := createJobForm("test_data/img.png", "kind", "test_flip")
+	require.Nil(t, err)
+	req, _ := http.NewRequest("POST", "/api/job/", buf)
+	req.Header.Add("Content-Type", contentType)
+	req.Header.Add("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	buf, contentType, err = createJobForm("test_data/img.png", "kind", "test_flip", "axis", "v")
+	require.Nil(t, err)
+	req, _ = http.NewRequest("POST", "/api/job/", buf)
+	req.Header.Add("Content-Type", contentType)
+	req.Header.Add("Authorization", "Token "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+	var resp Resp
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+	job := waitJob(t, dbw, resp.JobID)
+	assert.Equal(t, int64(JobStateDone), job.State)
 	var imgs []Image
 	assert.Nil(t, dbw.Select(&imgs, "select * from images where job_id=?", job.ID))
+	require.Equal(t, 1, len(imgs))
+	assert.Equal(t, 1236, imgs[0].Width)
+}
+
+func TestApiJobPostBase64(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	data, err := ioutil.ReadFile("test_data/img.png")
+	require.Nil(t, err)
+	payloads := []map[string]string{
+		{"kind": JOB_ORIG, "file": base64.StdEncoding.EncodeToString(data), "filename": "img.png"},
+		{"kind": JOB_ORIG, "file": "data:image/png;base64," + base64.StdEncoding.EncodeToString(data)},
+	}
+	for _, payload := range payloads {
+		req, _ := NewJsonRequest("/api/job/", payload)
+		req.Header.Add("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 202, w.Code)
+		var resp Resp
+		require.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+		job := waitJob(t, dbw, resp.JobID)
+		assert.Equal(t, int64(JobStateDone), job.State)
+		var imgs []Image
+		assert.Nil(t, dbw.Select(&imgs, "select * from images where job_id=?", job.ID))
+		require.Equal(t, 1, len(imgs))
+		assert.Equal(t, int64(167314), imgs[0].Size)
+		assert.Equal(t, "image/png", imgs[0].MimeType)
+	}
+
+	req, _ := NewJsonRequest("/api/job/", map[string]string{"kind": JOB_ORIG, "file": "!!!", "filename": "img.png"})
+	req.Header.Add("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestApiJobPostSniff(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	data, err := ioutil.ReadFile("test_data/img.png")
+	require.Nil(t, err)
+	post := func(payload map[string]string) (int, Resp) {
+		req, _ := NewJsonRequest("/api/job/", payload)
+		req.Header.Add("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp Resp
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+	html := base64.StdEncoding.EncodeToString([]byte("<html><script>alert(1)</script></html>"))
+	code, resp := post(map[string]string{"kind": JOB_ORIG, "file": "data:image/png;base64," + html})
+	assert.Equal(t, 415, code)
+	assert.Contains(t, resp.Error, "Unsupported file format")
+
+	code, resp = post(map[string]string{"kind": JOB_ORIG, "file": "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data)})
+	assert.Equal(t, 400, code)
+	assert.Contains(t, resp.Error, "does not match")
+
+	code, resp = post(map[string]string{"kind": JOB_ORIG, "file": base64.StdEncoding.EncodeToString(data), "filename": "evil.html"})
+	require.Equal(t, 202, code)
+	job := waitJob(t, dbw, resp.JobID)
+	assert.Equal(t, int64(JobStateDone), job.State)
+	var imgs []Image
+	assert.Nil(t, dbw.Select(&imgs, "select * from images where job_id=?", job.ID))
+	require.Equal(t, 1, len(imgs))
+	assert.Equal(t, "image/png", imgs[0].MimeType)
+	assert.True(t, strings.HasSuffix(imgs[0].Path, ".png"))
+}
+
+func TestApiJobPostDuplicate(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	post := func() Job {
+		buf, contentType, err := createJobForm("test_data/img.png", "kind", JOB_ALL_THREE)
+		require.Nil(t, err)
+		req, _ := http.NewRequest("POST", "/api/job/", buf)
+		req.Header.Add("Content-Type", contentType)
+		req.Header.Add("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 202, w.Code)
+		var resp Resp
+		require.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+		job := waitJob(t, dbw, resp.JobID)
+		require.Equal(t, int64(JobStateDone), job.State)
+		return job
+	}
+	first := post()
+	second := post()
+	ctx := context.Background()
+	firstImgs, err := dbw.JobImages(ctx, first.ID)
+	require.Nil(t, err)
+	secondImgs, err := dbw.JobImages(ctx, second.ID)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(secondImgs))
+	for i := range firstImgs {
+		assert.Equal(t, firstImgs[i].Kind, secondImgs[i].Kind)
+		assert.Equal(t, firstImgs[i].Path, secondImgs[i].Path)
+		assert.Equal(t, firstImgs[i].Size, secondImgs[i].Size)
+		assert.NotEqual(t, "", secondImgs[i].Digest)
+	}
+	assert.Equal(t, firstImgs[0].Digest, firstImgs[0].SourceDigest)
+	assert.Equal(t, firstImgs[0].Digest+".png", firstImgs[0].Path)
+
+	// files are kept while other images point to them
+	path := filepath.Join("/tmp/foo", firstImgs[0].Path)
+	code, _ := authRequest(router, "DELETE", fmt.Sprintf("/api/job/%s/", first.ID), token)
+	require.Equal(t, 200, code)
+	assert.FileExists(t, path)
+	code, _ = authRequest(router, "DELETE", fmt.Sprintf("/api/job/%s/", second.ID), token)
+	require.Equal(t, 200, code)
+	assert.NoFileExists(t, path)
+}
+
+func TestApiJobPostResize(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	post := func(fields ...string) (int, Resp) {
+		buf, contentType, err := createJobForm("test_data/img.png", append([]string{"kind", JOB_RESIZE}, fields...)...)
+		require.Nil(t, err)
+		req, _ := http.NewRequest("POST", "/api/job/", buf)
+		req.Header.Add("Content-Type", contentType)
+		req.Header.Add("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp Resp
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+	code, resp := post("width", "100", "mode", "fill")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "Width and height are required.", resp.Error)
+	code, _ = post("width", "0", "height", "100")
+	assert.Equal(t, 400, code)
+	// canvas is checked against the limit before the upload is accepted
+	code, resp = post("width", "8192", "height", "8192", "mode", "pad")
+	assert.Equal(t, 422, code)
+	assert.Equal(t, ErrCodeTooManyPixels, resp.Code)
+
+	code, resp = post("width", "100", "height", "100", "mode", "pad", "filter", "linear")
+	require.Equal(t, 202, code)
+	job := waitJob(t, dbw, resp.JobID)
+	require.Equal(t, int64(JobStateDone), job.State)
+	assert.Equal(t, JobParams{"width": "100", "height": "100", "mode": "pad", "filter": "linear"}, job.Params)
+	imgs, err := dbw.JobImages(context.Background(), job.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(imgs))
+	assert.Equal(t, JOB_RESIZE, imgs[0].Kind)
+	assert.Equal(t, 100, imgs[0].Width)
+	assert.Equal(t, 100, imgs[0].Height)
+
+	var jobResp JobResp
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/job/%s/", job.ID), nil)
+	req.Header.Add("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&jobResp))
+	assert.Equal(t, "pad", jobResp.Params["mode"])
+
+	// the same parameters reuse output, other ones do not
+	_, resp = post("width", "100", "height", "100", "mode", "pad", "filter", "linear")
+	same, _ := dbw.JobImages(context.Background(), waitJob(t, dbw, resp.JobID).ID)
+	require.Equal(t, 1, len(same))
+	assert.Equal(t, imgs[0].Path, same[0].Path)
+	_, resp = post("width", "100", "height", "100", "mode", "fill")
+	other, _ := dbw.JobImages(context.Background(), waitJob(t, dbw, resp.JobID).ID)
+	require.Equal(t, 1, len(other))
+	assert.NotEqual(t, imgs[0].Path, other[0].Path)
+}
+
+func TestApiJobPostOutputFormat(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	post := func(fields ...string) (int, Resp) {
+		buf, contentType, err := createJobForm("test_data/img.png", append([]string{"kind", JOB_ALL_THREE}, fields...)...)
+		require.Nil(t, err)
+		req, _ := http.NewRequest("POST", "/api/job/", buf)
+		req.Header.Add("Content-Type", contentType)
+		req.Header.Add("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp Resp
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+	code, _ := post("output_format", "webp")
+	assert.Equal(t, 400, code)
+	code, _ = post("output_format", "jpeg", "jpeg_quality", "0")
+	assert.Equal(t, 400, code)
+	code, _ = post("png_compression", "dummy")
+	assert.Equal(t, 400, code)
+
+	code, resp := post("output_format", "jpeg", "jpeg_quality", "80")
+	require.Equal(t, 202, code)
+	job := waitJob(t, dbw, resp.JobID)
+	require.Equal(t, int64(JobStateDone), job.State)
+	imgs, err := dbw.JobImages(context.Background(), job.ID)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(imgs))
+	for _, img := range imgs {
+		assert.Equal(t, "image/jpeg", img.MimeType, img.Kind)
+		assert.True(t, strings.HasSuffix(img.Path, ".jpg"), img.Path)
+		data, err := ioutil.ReadFile(filepath.Join("/tmp/foo", img.Path))
+		require.Nil(t, err)
+		format := SniffImageFormat(data)
+		require.NotNil(t, format)
+		assert.Equal(t, "image/jpeg", format.MimeType)
+	}
+
+	code, resp = post("png_compression", "best")
+	require.Equal(t, 202, code)
+	imgs, _ = dbw.JobImages(context.Background(), waitJob(t, dbw, resp.JobID).ID)
 	require.Equal(t, 3, len(imgs))
+	for _, img := range imgs {
+		assert.Equal(t, "image/png", img.MimeType, img.Kind)
+		assert.True(t, strings.HasSuffix(img.Path, ".png"), img.Path)
+	}
+}
+
+func TestApiJobPostOriented(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	post := func(fields ...string) []Image {
+		buf, contentType, err := createJobForm("test_data/rotated.jpg", append([]string{"kind", JOB_ALL_THREE}, fields...)...)
+		require.Nil(t, err)
+		req, _ := http.NewRequest("POST", "/api/job/", buf)
+		req.Header.Add("Content-Type", contentType)
+		req.Header.Add("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 202, w.Code)
+		var resp Resp
+		require.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+		job := waitJob(t, dbw, resp.JobID)
+		require.Equal(t, int64(JobStateDone), job.State, job.Error)
+		imgs, err := dbw.JobImages(context.Background(), job.ID)
+		require.Nil(t, err)
+		require.Equal(t, 3, len(imgs))
+		return imgs
+	}
+	readImage := func(img Image) ([]byte, image.Image) {
+		data, err := ioutil.ReadFile(filepath.Join("/tmp/foo", img.Path))
+		require.Nil(t, err)
+		decoded, err := imaging.Decode(bytes.NewReader(data))
+		require.Nil(t, err)
+		return data, decoded
+	}
+	upload, _ := ioutil.ReadFile("test_data/rotated.jpg")
+
+	// 40x20 with orientation 6 is shown as 20x40, red on top
+	imgs := post()
+	assert.Equal(t, JOB_ORIG, imgs[0].Kind)
+	assert.Equal(t, 20, imgs[0].Width)
+	assert.Equal(t, 40, imgs[0].Height)
+	data, _ := readImage(imgs[0])
+	assert.Equal(t, upload, data)
+	assert.Equal(t, JOB_SQUARE_ORIG, imgs[1].Kind)
+	_, square := readImage(imgs[1])
+	assert.Equal(t, image.Rect(0, 0, 40, 40), square.Bounds())
+	r, _, b, _ := square.At(20, 5).RGBA()
+	assert.True(t, r > b)
+	r, _, b, _ = square.At(20, 35).RGBA()
+	assert.True(t, b > r)
+
+	imgs = post("strip_metadata", "true")
+	assert.Equal(t, 20, imgs[0].Width)
+	assert.Equal(t, 40, imgs[0].Height)
+	data, orig := readImage(imgs[0])
+	assert.False(t, bytes.Contains(data, []byte("Exif")))
+	assert.Equal(t, image.Rect(0, 0, 20, 40), orig.Bounds())
+	r, _, b, _ = orig.At(10, 5).RGBA()
+	assert.True(t, r > b)
+}
+
+func TestApiJobPostLimits(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	app := NewApp(dbw, mediaRoot)
+	app.TOKEN_SECRET = testTokenSecret
+	router := app.SetupRouter(gin.New())
+	post := func(req *http.Request) (int, Resp) {
+		req.Header.Add("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp Resp
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+	postFile := func(filePath string) (int, Resp) {
+		buf, contentType, err := createJobForm(filePath, "kind", JOB_SQUARE_SMALL)
+		require.Nil(t, err)
+		req, _ := http.NewRequest("POST", "/api/job/", buf)
+		req.Header.Add("Content-Type", contentType)
+		return post(req)
+	}
+
+	for _, path := range []string{"test_data/bomb.png", "test_data/bomb.gif"} {
+		code, resp := postFile(path)
+		assert.Equal(t, 422, code, path)
+		assert.Equal(t, ErrCodeTooManyPixels, resp.Code, path)
+	}
+	staged, err := ioutil.ReadDir(StagingDir(mediaRoot))
+	require.Nil(t, err)
+	assert.Empty(t, staged)
+
+	app.MAX_FILE_SIZE = 1000
+	code, resp := postFile("test_data/img.png")
+	assert.Equal(t, 413, code)
+	assert.Equal(t, ErrCodeFileTooLarge, resp.Code)
+	data, _ := ioutil.ReadFile("test_data/img.png")
+	req, _ := NewJsonRequest("/api/job/", map[string]string{
+		"kind": JOB_ORIG, "file": base64.StdEncoding.EncodeToString(data)})
+	code, resp = post(req)
+	assert.Equal(t, 413, code)
+	assert.Equal(t, ErrCodeFileTooLarge, resp.Code)
+
+	app.MAX_BODY_SIZE = 1000
+	code, resp = postFile("test_data/img.png")
+	assert.Equal(t, 413, code)
+	assert.Equal(t, ErrCodeBodyTooLarge, resp.Code)
+	// length is not known in advance
+	buf, contentType, err := createJobForm("test_data/img.png", "kind", JOB_ORIG)
+	require.Nil(t, err)
+	req, _ = http.NewRequest("POST", "/api/job/", ioutil.NopCloser(buf))
+	req.Header.Add("Content-Type", contentType)
+	code, resp = post(req)
+	assert.Equal(t, 413, code)
+	assert.Equal(t, ErrCodeBodyTooLarge, resp.Code)
+
+	app.MAX_BODY_SIZE = DefaultMaxBodySize
+	app.MAX_FILE_SIZE = DefaultMaxFileSize
+	app.MAX_PIXELS = 100
+	code, resp = postFile("test_data/img.png")
+	assert.Equal(t, 422, code)
+	assert.Equal(t, ErrCodeTooManyPixels, resp.Code)
+	app.MAX_PIXELS = DefaultMaxPixels
+	code, _ = postFile("test_data/img.png")
+	assert.Equal(t, 202, code)
+}
+
+func createBatchForm(filePaths []string, fields ...string) (*bytes.Buffer, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, filePath := range filePaths {
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return &buf, "", err
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files[]"; filename="%s"`, filepath.Base(filePath)))
+		h.Set("Content-Type", mime.TypeByExtension(filepath.Ext(filePath)))
+		fw, err := w.CreatePart(h)
+		if err != nil {
+			return &buf, "", err
+		}
+		fw.Write(data)
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		if err := w.WriteField(fields[i], fields[i+1]); err != nil {
+			return &buf, "", err
+		}
+	}
+	w.Close()
+	return &buf, w.FormDataContentType(), nil
+}
+
+type BatchPostResp struct {
+	OK      bool     `json:"ok"`
+	Error   string   `json:"error,omitempty"`
+	BatchID string   `json:"batch_id"`
+	JobIDs  []string `json:"job_ids"`
+}
+
+func TestApiBatch(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	_, otherToken := createTestUser("spam", "egg", dbw)
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	app := NewApp(dbw, mediaRoot)
+	app.TOKEN_SECRET = testTokenSecret
+	router := app.SetupRouter(gin.New())
+	send := func(req *http.Request, token string, v interface{}) int {
+		req.Header.Add("Authorization", "Token "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		json.NewDecoder(w.Body).Decode(v)
+		return w.Code
+	}
+	postForm := func(paths []string, fields ...string) (int, BatchPostResp) {
+		buf, contentType, err := createBatchForm(paths, fields...)
+		require.Nil(t, err)
+		req, _ := http.NewRequest("POST", "/api/batch/", buf)
+		req.Header.Add("Content-Type", contentType)
+		var resp BatchPostResp
+		return send(req, token, &resp), resp
+	}
+	getBatch := func(id, token string) (int, BatchResp) {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/api/batch/%s/", id), nil)
+		var resp BatchResp
+		return send(req, token, &resp), resp
+	}
+
+	code, resp := postForm(nil, "kind", JOB_ORIG)
+	assert.Equal(t, 400, code)
+	code, _ = postForm([]string{"test_data/img.png"}, "kind", "dummy")
+	assert.Equal(t, 400, code)
+	code, _ = postForm([]string{"test_data/img.png"}, "kind", JOB_RESIZE)
+	assert.Equal(t, 400, code)
+	code, resp = postForm([]string{"test_data/img.png", "test_data/bomb.png"}, "kind", JOB_ORIG)
+	assert.Equal(t, 422, code)
+	assert.True(t, strings.HasPrefix(resp.Error, "File 1: "), resp.Error)
+	staged, err := ioutil.ReadDir(StagingDir(mediaRoot))
+	require.Nil(t, err)
+	assert.Empty(t, staged)
+	app.MAX_BATCH_FILES = 1
+	code, _ = postForm([]string{"test_data/img.png", "test_data/img.png"}, "kind", JOB_ORIG)
+	assert.Equal(t, 400, code)
+	app.MAX_BATCH_FILES = DefaultMaxBatchFiles
+	// batch the queue has no room for is rejected as a whole
+	queue := app.Queue
+	app.Queue = NewJobQueue(dbw, app.Storage, 1, 1)
+	code, resp = postForm([]string{"test_data/img.png", "test_data/img.png"}, "kind", JOB_ORIG)
+	assert.Equal(t, 503, code)
+	assert.Equal(t, ErrQueueFull.Error(), resp.Error)
+	app.Queue = queue
+	staged, err = ioutil.ReadDir(StagingDir(mediaRoot))
+	require.Nil(t, err)
+	assert.Empty(t, staged)
+	var batches int
+	require.Nil(t, dbw.GetContext(context.Background(), &batches, "select count(*) from batches"))
+	assert.Equal(t, 0, batches)
+	// output size is checked once size of the upload is known
+	app.MAX_PIXELS = 1236 * 624
+	code, resp = postForm([]string{"test_data/img.png"}, "kind", JOB_RESIZE, "width", "2000")
+	assert.Equal(t, 422, code)
+	assert.Equal(t, "File 0: Image 2000x1010 is too large, it may have at most 771264 pixels.", resp.Error)
+	code, resp = postForm([]string{"test_data/img.png"}, "kind", JOB_RESIZE, "width", "1000")
+	assert.Equal(t, 202, code)
+	waitJob(t, dbw, resp.JobIDs[0])
+	app.MAX_PIXELS = DefaultMaxPixels
+
+	code, resp = postForm([]string{"test_data/img.png", "test_data/rotated.jpg"}, "kind", JOB_SQUARE_SMALL, "gravity", "top")
+	require.Equal(t, 202, code)
+	require.Equal(t, 2, len(resp.JobIDs))
+	for _, id := range resp.JobIDs {
+		job := waitJob(t, dbw, id)
+		assert.Equal(t, int64(JobStateDone), job.State)
+		assert.Equal(t, resp.BatchID, job.BatchID)
+		assert.Equal(t, JobParams{"gravity": "top"}, job.Params)
+	}
+	code, batch := getBatch(resp.BatchID, token)
+	require.Equal(t, 200, code)
+	assert.Equal(t, JOB_SQUARE_SMALL, batch.Kind)
+	assert.Equal(t, "done", batch.State)
+	assert.Equal(t, 2, batch.Total)
+	assert.Equal(t, 2, batch.Done)
+	require.Equal(t, 2, len(batch.Jobs))
+	assert.Equal(t, resp.JobIDs[0], batch.Jobs[0].PK)
+	require.Equal(t, 2, len(batch.Images))
+	assert.Equal(t, batch.Jobs[1].Images[0], batch.Images[1])
+
+	code, _ = getBatch(resp.BatchID, otherToken)
+	assert.Equal(t, 403, code)
+	code, _ = getBatch("dummy", token)
+	assert.Equal(t, 404, code)
+
+	png, _ := ioutil.ReadFile("test_data/img.png")
+	body, _ := json.Marshal(BatchCall{
+		Kind:      JOB_ORIG,
+		Files:     []string{base64.StdEncoding.EncodeToString(png), "bm90IGFuIGltYWdl"},
+		FileNames: []string{"first.png"},
+	})
+	req, _ := http.NewRequest("POST", "/api/batch/", bytes.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	code = send(req, token, &resp)
+	assert.Equal(t, 415, code)
+	assert.True(t, strings.HasPrefix(resp.Error, "File 1: "), resp.Error)
+	postJSON := func(call BatchCall) (int, BatchPostResp) {
+		body, _ := json.Marshal(call)
+		req, _ := http.NewRequest("POST", "/api/batch/", bytes.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		var resp BatchPostResp
+		return send(req, token, &resp), resp
+	}
+	code, resp = postJSON(BatchCall{Kind: JOB_ORIG, Files: []string{base64.StdEncoding.EncodeToString(png), "!!!"}})
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "File 1: File is not valid base64.", resp.Error)
+	// files are counted before any of them is decoded
+	app.MAX_BATCH_FILES = 1
+	code, resp = postJSON(BatchCall{Kind: JOB_ORIG, Files: []string{"!!!", "!!!"}})
+	assert.Equal(t, 400, code)
+	assert.Equal(t, "Batch may have at most 1 files.", resp.Error)
+	app.MAX_BATCH_FILES = DefaultMaxBatchFiles
+	staged, err = ioutil.ReadDir(StagingDir(mediaRoot))
+	require.Nil(t, err)
+	assert.Empty(t, staged)
+
+	body, _ = json.Marshal(BatchCall{Kind: JOB_ORIG, Files: []string{base64.StdEncoding.EncodeToString(png)}})
+	req, _ = http.NewRequest("POST", "/api/batch/", bytes.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	resp = BatchPostResp{}
+	require.Equal(t, 202, send(req, token, &resp))
+	require.Equal(t, 1, len(resp.JobIDs))
+	waitJob(t, dbw, resp.JobIDs[0])
+	_, batch = getBatch(resp.BatchID, token)
+	assert.Equal(t, "done", batch.State)
+	assert.Equal(t, 1, len(batch.Images))
+}
+
+// Reads event names of server-sent events until the stream ends,
+// it runs in goroutines of tests, so failures do not stop them
+func readEventNames(t *testing.T, url, token string) []string {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Authorization", "Token "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	defer resp.Body.Close()
+	if !assert.Equal(t, 200, resp.StatusCode) {
+		return nil
+	}
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	var names []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "event:") {
+			names = append(names, strings.TrimPrefix(scanner.Text(), "event:"))
+		}
+	}
+	return names
+}
+
+func TestApiJobEvents(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	_, otherToken := createTestUser("spam", "egg", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	app := NewApp(dbw, "/tmp/foo")
+	app.TOKEN_SECRET = testTokenSecret
+	router := app.SetupRouter(gin.New())
+	// jobs wait in the queue until it is started
+	queue := NewJobQueue(dbw, app.Storage, 1, 10)
+	app.Queue = queue
+	defer queue.Stop()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	buf, contentType, err := createJobForm("test_data/img.png", "kind", JOB_ALL_THREE)
+	require.Nil(t, err)
+	req, _ := http.NewRequest("POST", "/api/job/", buf)
+	req.Header.Add("Content-Type", contentType)
+	req.Header.Add("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+	var resp Resp
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+	url := fmt.Sprintf("%s/api/job/%s/events/", server.URL, resp.JobID)
+
+	code, _ := authRequest(router, "GET", fmt.Sprintf("/api/job/%s/events/", resp.JobID), otherToken)
+	assert.Equal(t, 403, code)
+	code, _ = authRequest(router, "GET", "/api/job/dummy/events/", token)
+	assert.Equal(t, 404, code)
+
+	names := make(chan []string)
+	go func() {
+		names <- readEventNames(t, url, token)
+	}()
+	// let the stream subscribe before the job runs
+	time.Sleep(100 * time.Millisecond)
+	queue.Start()
+	expected := []string{JobEventQueued, JobEventStarted, JobEventImage, JobEventImage, JobEventImage, JobEventDone}
+	select {
+	case got := <-names:
+		assert.Equal(t, expected, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream did not end")
+	}
+
+	// finished job is told at once
+	waitJob(t, dbw, resp.JobID)
+	assert.Equal(t, expected[2:], readEventNames(t, url, token))
+}
+
+func TestApiJobEventsDropped(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	app := NewApp(dbw, "/tmp/foo")
+	app.TOKEN_SECRET = testTokenSecret
+	router := app.SetupRouter(gin.New())
+	queue := NewJobQueue(dbw, app.Storage, 1, 10)
+	app.Queue = queue
+	defer queue.Stop()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	buf, contentType, err := createJobForm("test_data/img.png", "kind", JOB_ORIG)
+	require.Nil(t, err)
+	req, _ := http.NewRequest("POST", "/api/job/", buf)
+	req.Header.Add("Content-Type", contentType)
+	req.Header.Add("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+	var resp Resp
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	names := make(chan []string)
+	go func() {
+		names <- readEventNames(t, fmt.Sprintf("%s/api/job/%s/events/", server.URL, resp.JobID), token)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	// drop the stream like subscriber falling behind
+	queue.Events.mu.Lock()
+	for ch := range queue.Events.subs[resp.JobID] {
+		queue.Events.remove(resp.JobID, ch)
+	}
+	queue.Events.mu.Unlock()
+	queue.Start()
+	// the rest is told by the database
+	select {
+	case got := <-names:
+		// started may be seen by polling or missed, nothing is repeated
+		require.True(t, len(got) == 3 || len(got) == 4, got)
+		assert.Equal(t, JobEventQueued, got[0])
+		assert.Equal(t, []string{JobEventImage, JobEventDone}, got[len(got)-2:])
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream did not end")
+	}
 }
 
 func TestApiJobGet(t *testing.T) {
 	dbw, err := testDBWorker()
 	defer removeWorker(dbw)
 	require.Nil(t, err)
-	require.Nil(t, dbw.createTables())
-	user, _ := createTestUser("foo", "bar", dbw)
+	require.Nil(t, dbw.CreateTables())
+	user, token := createTestUser("foo", "bar", dbw)
 	job, _ := NewJob(user.ID, JOB_ORIG)
-	require.Nil(t, dbw.SaveNewJob(job))
-	img, _ := NewImage(job, "/tmp", "foo.png", "image/png")
-	require.Nil(t, dbw.SaveNewImage(img))
+	require.Nil(t, dbw.SaveNewJob(context.Background(), job))
+	img, _ := NewImage(job, "foo.png", "image/png")
+	require.Nil(t, dbw.SaveNewImage(context.Background(), img))
 	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/job/%s/", job.ID), nil)
-	req.Header.Add("Authorization", "Token "+user.Token)
+	req.Header.Add("Authorization", "Token "+token)
 
 	w := httptest.NewRecorder()
 	router := setupTestRouter(dbw, "/tmp/foo")
@@ -286,24 +1179,151 @@ func TestApiJobGet(t *testing.T) {
 	require.True(t, resp.OK)
 	assert.Equal(t, job.ID, resp.PK)
 	assert.Equal(t, 1, len(resp.Images))
+	assert.Equal(t, JOB_ORIG, resp.Kind)
+	assert.Equal(t, "started", resp.State)
+	assert.Nil(t, resp.StartedAt)
+	assert.False(t, resp.CreatedAt.IsZero())
+}
+
+func getJobList(t *testing.T, router *gin.Engine, path, token string) (int, JobListResp) {
+	var resp JobListResp
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Add("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+	return w.Code, resp
+}
+
+func TestApiJobList(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	ctx := context.Background()
+	user, token := createTestUser("foo", "bar", dbw)
+	other, _ := createTestUser("spam", "egg", dbw)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		kind := JOB_ORIG
+		if i%2 == 1 {
+			kind = JOB_SQUARE_SMALL
+		}
+		job, _ := NewJob(user.ID, kind)
+		if i == 4 {
+			job.Finish(nil)
+		}
+		require.Nil(t, dbw.SaveNewJob(ctx, job))
+		img, _ := NewImage(job, "foo.png", "image/png")
+		require.Nil(t, dbw.SaveNewImage(ctx, img))
+		ids = append(ids, job.ID)
+	}
+	otherJob, _ := NewJob(other.ID, JOB_ORIG)
+	require.Nil(t, dbw.SaveNewJob(ctx, otherJob))
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+
+	code, resp := getJobList(t, router, "/api/jobs/?limit=2", token)
+	require.Equal(t, 200, code)
+	require.Equal(t, 2, len(resp.Jobs))
+	assert.Equal(t, ids[0], resp.Jobs[0].PK)
+	assert.Equal(t, ids[1], resp.Jobs[1].PK)
+	assert.Equal(t, 1, len(resp.Jobs[0].Images))
+	assert.Equal(t, ids[1], resp.Next)
+	var seen []string
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		code, resp = getJobList(t, router, "/api/jobs/?limit=2&cursor="+cursor, token)
+		require.Equal(t, 200, code)
+		for _, job := range resp.Jobs {
+			seen = append(seen, job.PK)
+		}
+		if resp.Next == "" {
+			break
+		}
+		cursor = resp.Next
+	}
+	assert.Equal(t, ids, seen)
+
+	code, resp = getJobList(t, router, "/api/jobs/?kind="+JOB_SQUARE_SMALL, token)
+	require.Equal(t, 200, code)
+	assert.Equal(t, 2, len(resp.Jobs))
+	assert.Equal(t, "", resp.Next)
+	code, resp = getJobList(t, router, "/api/jobs/?state=done", token)
+	require.Equal(t, 200, code)
+	require.Equal(t, 1, len(resp.Jobs))
+	assert.Equal(t, "done", resp.Jobs[0].State)
+
+	code, _ = getJobList(t, router, "/api/jobs/?state=dummy", token)
+	assert.Equal(t, 400, code)
+	code, _ = getJobList(t, router, "/api/jobs/?limit=1000", token)
+	assert.Equal(t, 400, code)
+	_, otherToken := createTestUser("bar", "egg", dbw)
+	code, resp = getJobList(t, router, "/api/jobs/", otherToken)
+	require.Equal(t, 200, code)
+	assert.NotNil(t, resp.Jobs)
+	assert.Equal(t, 0, len(resp.Jobs))
+}
+
+func TestApiJobGetFailed(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	_, token := createTestUser("foo", "bar", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="file"; filename="foo.png"`)
+	h.Set("Content-Type", "image/png")
+	fw, _ := mw.CreatePart(h)
+	fw.Write([]byte("\x89PNG\r\n\x1a\nbroken"))
+	mw.WriteField("kind", JOB_SQUARE_SMALL)
+	mw.Close()
+	req, _ := http.NewRequest("POST", "/api/job/", &buf)
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+	req.Header.Add("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 202, w.Code)
+	var postResp Resp
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&postResp))
+	waitJob(t, dbw, postResp.JobID)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/api/job/%s/", postResp.JobID), nil)
+	req.Header.Add("Authorization", "Token "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	var resp JobResp
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "failed", resp.State)
+	assert.NotEqual(t, "", resp.Error)
+	require.NotNil(t, resp.StartedAt)
+	require.NotNil(t, resp.FinishedAt)
+	assert.Equal(t, 0, len(resp.Images))
 }
 
 func TestApiImageGet(t *testing.T) {
 	dbw, err := testDBWorker()
 	defer removeWorker(dbw)
 	assert.Nil(t, err)
-	assert.Nil(t, dbw.createTables())
-	user, _ := createTestUser("foo", "bar", dbw)
+	assert.Nil(t, dbw.CreateTables())
+	user, token := createTestUser("foo", "bar", dbw)
 	os.MkdirAll("/tmp/foo", os.ModePerm)
 	defer os.Remove("/tmp/foo")
 	job, _ := NewJob(user.ID, JOB_ORIG)
-	img, _ := NewImage(job, "/tmp/foo", "foo.png", "image/png")
-	require.Nil(t, dbw.SaveNewJob(job))
-	require.Nil(t, dbw.SaveNewImage(img))
-	cpCmd := exec.Command("cp", "test_data/img.png", img.Path)
+	img, _ := NewImage(job, "foo.png", "image/png")
+	require.Nil(t, dbw.SaveNewJob(context.Background(), job))
+	require.Nil(t, dbw.SaveNewImage(context.Background(), img))
+	cpCmd := exec.Command("cp", "test_data/img.png", filepath.Join("/tmp/foo", img.Path))
 	require.Nil(t, cpCmd.Run())
 	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/image/%s/", img.ID), nil)
-	req.Header.Add("Authorization", "Token "+user.Token)
+	req.Header.Add("Authorization", "Token "+token)
 
 	w := httptest.NewRecorder()
 	router := setupTestRouter(dbw, "/tmp/foo")
@@ -315,8 +1335,188 @@ func TestApiImageGet(t *testing.T) {
 
 }
 
-// Returns buffer with form, content type and error
-func createJobForm(filePath string, fieldName, fieldValue string) (*bytes.Buffer, string, error) {
+func TestApiImageMeta(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	ctx := context.Background()
+	user, token := createTestUser("foo", "bar", dbw)
+	_, otherToken := createTestUser("spam", "egg", dbw)
+	job, _ := NewJob(user.ID, JOB_ALL_THREE)
+	require.Nil(t, dbw.SaveNewJob(ctx, job))
+	var ids []string
+	for _, kind := range []string{JOB_ORIG, JOB_SQUARE_ORIG, JOB_SQUARE_SMALL} {
+		img, _ := NewImage(job, "foo.png", "image/png")
+		img.Kind = kind
+		img.Width, img.Height, img.Size = 256, 128, 1000
+		require.Nil(t, dbw.SaveNewImage(ctx, img))
+		ids = append(ids, img.ID)
+	}
+	otherJob, _ := NewJob(user.ID, JOB_ORIG)
+	require.Nil(t, dbw.SaveNewJob(ctx, otherJob))
+	img, _ := NewImage(otherJob, "foo.png", "image/png")
+	img.Kind = JOB_ORIG
+	require.Nil(t, dbw.SaveNewImage(ctx, img))
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/image/%s/meta/", ids[0]), nil)
+	req.Header.Add("Authorization", "Token "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "/tmp/foo")
+	var meta ImageMetaResp
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&meta))
+	assert.True(t, meta.OK)
+	assert.Equal(t, ids[0], meta.PK)
+	assert.Equal(t, job.ID, meta.JobID)
+	assert.Equal(t, JOB_ORIG, meta.Kind)
+	assert.Equal(t, "image/png", meta.MimeType)
+	assert.Equal(t, 256, meta.Width)
+	assert.Equal(t, 128, meta.Height)
+	assert.Equal(t, int64(1000), meta.Size)
+	assert.False(t, meta.CreatedAt.IsZero())
+
+	code, _ := authRequest(router, "GET", fmt.Sprintf("/api/image/%s/meta/", ids[0]), otherToken)
+	assert.Equal(t, 403, code)
+	code, _ = authRequest(router, "GET", "/api/image/dummy/meta/", token)
+	assert.Equal(t, 404, code)
+
+	var list ImageListResp
+	req, _ = http.NewRequest("GET", "/api/images/?limit=3", nil)
+	req.Header.Add("Authorization", "Token "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Equal(t, 3, len(list.Images))
+	assert.NotEqual(t, "", list.Next)
+
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/api/images/?job=%s&kind=%s", job.ID, JOB_SQUARE_SMALL), nil)
+	req.Header.Add("Authorization", "Token "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	list = ImageListResp{}
+	require.Nil(t, json.NewDecoder(w.Body).Decode(&list))
+	require.Equal(t, 1, len(list.Images))
+	assert.Equal(t, ids[2], list.Images[0].PK)
+	assert.Equal(t, "", list.Next)
+}
+
+func TestApiImageDelete(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	ctx := context.Background()
+	user, token := createTestUser("foo", "bar", dbw)
+	_, otherToken := createTestUser("spam", "egg", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	job, _ := NewJob(user.ID, JOB_ORIG)
+	require.Nil(t, dbw.SaveNewJob(ctx, job))
+	img, _ := NewImage(job, "foo.png", "image/png")
+	require.Nil(t, dbw.SaveNewImage(ctx, img))
+	require.Nil(t, exec.Command("cp", "test_data/img.png", filepath.Join("/tmp/foo", img.Path)).Run())
+	path := fmt.Sprintf("/api/image/%s/", img.ID)
+
+	code, _ := authRequest(router, "DELETE", path, otherToken)
+	assert.Equal(t, 403, code)
+	assert.FileExists(t, filepath.Join("/tmp/foo", img.Path))
+	code, resp := authRequest(router, "DELETE", path, token)
+	assert.Equal(t, 200, code)
+	assert.True(t, resp.OK)
+	assert.NoFileExists(t, filepath.Join("/tmp/foo", img.Path))
+	assert.True(t, IsNotFound(dbw.LoadImage(ctx, img, img.ID)))
+	code, _ = authRequest(router, "DELETE", path, token)
+	assert.Equal(t, 404, code)
+
+	// file is already gone
+	img, _ = NewImage(job, "foo.png", "image/png")
+	require.Nil(t, dbw.SaveNewImage(ctx, img))
+	code, _ = authRequest(router, "DELETE", fmt.Sprintf("/api/image/%s/", img.ID), token)
+	assert.Equal(t, 200, code)
+}
+
+func TestApiJobDelete(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	ctx := context.Background()
+	user, token := createTestUser("foo", "bar", dbw)
+	_, otherToken := createTestUser("spam", "egg", dbw)
+	os.MkdirAll("/tmp/foo", os.ModePerm)
+	router := setupTestRouter(dbw, "/tmp/foo")
+	job, _ := NewJob(user.ID, JOB_ALL_THREE)
+	require.Nil(t, dbw.SaveNewJob(ctx, job))
+	var imgs []*Image
+	for i := 0; i < 3; i++ {
+		img, _ := NewImage(job, "foo.png", "image/png")
+		require.Nil(t, dbw.SaveNewImage(ctx, img))
+		imgs = append(imgs, img)
+	}
+	// the last one is missing on disk
+	for _, img := range imgs[:2] {
+		require.Nil(t, exec.Command("cp", "test_data/img.png", filepath.Join("/tmp/foo", img.Path)).Run())
+	}
+	path := fmt.Sprintf("/api/job/%s/", job.ID)
+
+	code, resp := authRequest(router, "DELETE", path, token)
+	assert.Equal(t, 409, code)
+	assert.False(t, resp.OK)
+	job.Finish(nil)
+	require.Nil(t, dbw.SaveJob(ctx, job))
+	code, _ = authRequest(router, "DELETE", path, otherToken)
+	assert.Equal(t, 403, code)
+	code, resp = authRequest(router, "DELETE", path, token)
+	assert.Equal(t, 200, code)
+	assert.True(t, resp.OK)
+	for _, img := range imgs {
+		assert.NoFileExists(t, filepath.Join("/tmp/foo", img.Path))
+		assert.True(t, IsNotFound(dbw.LoadImage(ctx, img, img.ID)))
+	}
+	assert.True(t, IsNotFound(dbw.LoadJob(ctx, job, job.ID)))
+	code, _ = authRequest(router, "DELETE", path, token)
+	assert.Equal(t, 404, code)
+}
+
+// Job interrupted by restart becomes deletable once the queue recovers it
+func TestApiJobDeleteInterrupted(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	ctx := context.Background()
+	user, token := createTestUser("foo", "bar", dbw)
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	job, _ := NewJob(user.ID, JOB_ORIG)
+	job.Start()
+	require.Nil(t, dbw.SaveNewJob(ctx, job))
+	path := fmt.Sprintf("/api/job/%s/", job.ID)
+
+	app := NewApp(dbw, mediaRoot)
+	app.TOKEN_SECRET = testTokenSecret
+	_, failed, err := app.Queue.Recover(ctx, app.INSTANCE, mediaRoot)
+	require.Nil(t, err)
+	assert.Equal(t, 1, failed)
+	router := app.SetupRouter(gin.New())
+	code, _ := authRequest(router, "GET", path, token)
+	assert.Equal(t, 200, code)
+	code, resp := authRequest(router, "DELETE", path, token)
+	assert.Equal(t, 200, code)
+	assert.True(t, resp.OK)
+	assert.True(t, IsNotFound(dbw.LoadJob(ctx, job, job.ID)))
+}
+
+// Returns buffer with form, content type and error,
+// fields are pairs of form field name and value
+func createJobForm(filePath string, fields ...string) (*bytes.Buffer, string, error) {
 	var buf bytes.Buffer
 	var err error
 	w := multipart.NewWriter(&buf)
@@ -327,18 +1527,20 @@ func createJobForm(filePath string, fieldName, fieldValue string) (*bytes.Buffer
 	var fw io.Writer
 	h := make(textproto.MIMEHeader)
 	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, file.Name()))
-	h.Set("Content-Type", "image/png")
+	h.Set("Content-Type", mime.TypeByExtension(filepath.Ext(filePath)))
 	if fw, err = w.CreatePart(h); err != nil {
 		return &buf, "", err
 	}
 	if _, err = io.Copy(fw, file); err != nil {
 		return &buf, "", err
 	}
-	if fw, err = w.CreateFormField(fieldName); err != nil {
-		return &buf, "", err
-	}
-	if _, err = fw.Write([]byte(fieldValue)); err != nil {
-		return &buf, "", err
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fw, err = w.CreateFormField(fields[i]); err != nil {
+			return &buf, "", err
+		}
+		if _, err = fw.Write([]byte(fields[i+1])); err != nil {
+			return &buf, "", err
+		}
 	}
 	w.Close()
 
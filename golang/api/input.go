@@ -0,0 +1,234 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job file and parameters as received, regardless of request encoding.
+// MimeType is declared by client and may be empty.
+type jobInput struct {
+	Kind     string
+	Params   map[string]string
+	FileName string
+	MimeType string
+	Size     int64
+	Body     io.ReadCloser
+	// Base64 file of JSON batch decoded by load, Body is nil until then
+	payload string
+}
+
+// Decodes file of JSON batch input, so batch keeps one decoded file at a time
+func (in *jobInput) load() error {
+	if in.Body != nil {
+		return nil
+	}
+	data, mimeType, err := decodeBase64Payload(in.payload)
+	if err != nil {
+		return err
+	}
+	in.payload = ""
+	in.MimeType = mimeType
+	in.Size = int64(len(data))
+	in.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return nil
+}
+
+// Closes body and drops file content
+func (in *jobInput) close() {
+	if in.Body != nil {
+		in.Body.Close()
+	}
+	in.Body = nil
+	in.payload = ""
+}
+
+// Body of JSON job request
+type JobCall struct {
+	Kind     string            `json:"kind"`
+	File     string            `json:"file"`
+	FileName string            `json:"filename"`
+	Params   map[string]string `json:"params"`
+}
+
+// Body of JSON batch request, FileNames are optional and match Files by index
+type BatchCall struct {
+	Kind      string            `json:"kind"`
+	Files     []string          `json:"files"`
+	FileNames []string          `json:"filenames"`
+	Params    map[string]string `json:"params"`
+}
+
+// Returns form values except files and kind as processor parameters
+func formParams(c *gin.Context) map[string]string {
+	params := make(map[string]string)
+	for key, values := range c.Request.PostForm {
+		if key == "kind" || key == "file" || key == "files[]" || key == "files" || len(values) == 0 {
+			continue
+		}
+		params[key] = values[0]
+	}
+	return params
+}
+
+func jobInputFromForm(c *gin.Context) (*jobInput, error) {
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return nil, errors.New("No file is received.")
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, errors.New("Could not read file.")
+	}
+	return &jobInput{
+		Kind:     c.PostForm("kind"),
+		Params:   formParams(c),
+		FileName: fileHeader.Filename,
+		MimeType: fileHeader.Header.Get("Content-Type"),
+		Size:     fileHeader.Size,
+		Body:     file,
+	}, nil
+}
+
+func jobInputFromJSON(c *gin.Context) (*jobInput, error) {
+	var call JobCall
+	if err := c.ShouldBindJSON(&call); err != nil {
+		return nil, errors.New("Could not parse request.")
+	}
+	if call.File == "" {
+		return nil, errors.New("No file is received.")
+	}
+	data, mimeType, err := decodeBase64Payload(call.File)
+	if err != nil {
+		return nil, err
+	}
+	params := call.Params
+	if params == nil {
+		params = make(map[string]string)
+	}
+	return &jobInput{
+		Kind:     call.Kind,
+		Params:   params,
+		FileName: call.FileName,
+		MimeType: mimeType,
+		Size:     int64(len(data)),
+		Body:     ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+// Decodes plain base64 or data URI, returns bytes and media type of data URI
+func decodeBase64Payload(payload string) ([]byte, string, error) {
+	var mimeType string
+	payload = strings.TrimSpace(payload)
+	if strings.HasPrefix(payload, "data:") {
+		comma := strings.Index(payload, ",")
+		if comma < 0 {
+			return nil, "", errors.New("Data URI is not valid.")
+		}
+		meta := payload[len("data:"):comma]
+		if !strings.HasSuffix(meta, ";base64") {
+			return nil, "", errors.New("Data URI should be base64 encoded.")
+		}
+		mimeType = strings.Split(strings.TrimSuffix(meta, ";base64"), ";")[0]
+		payload = payload[comma+1:]
+	}
+	payload = strings.NewReplacer("\n", "", "\r", "", " ", "").Replace(payload)
+	enc := base64.StdEncoding
+	if strings.ContainsAny(payload, "-_") {
+		enc = base64.URLEncoding
+	}
+	if !strings.HasSuffix(payload, "=") && len(payload)%4 != 0 {
+		enc = enc.WithPadding(base64.NoPadding)
+	}
+	data, err := enc.DecodeString(payload)
+	if err != nil {
+		return nil, "", errors.New("File is not valid base64.")
+	}
+	return data, mimeType, nil
+}
+
+func tooManyFilesError(maxFiles int) error {
+	return fmt.Errorf("Batch may have at most %d files.", maxFiles)
+}
+
+// Returns inputs of every file of multipart batch sent as files[] or files
+func batchInputsFromForm(c *gin.Context, maxFiles int) ([]*jobInput, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, errors.New("No file is received.")
+	}
+	var headers []*multipart.FileHeader
+	headers = append(headers, form.File["files[]"]...)
+	headers = append(headers, form.File["files"]...)
+	if len(headers) == 0 {
+		return nil, errors.New("No file is received.")
+	}
+	if len(headers) > maxFiles {
+		return nil, tooManyFilesError(maxFiles)
+	}
+	kind := c.PostForm("kind")
+	params := formParams(c)
+	inputs := make([]*jobInput, 0, len(headers))
+	for _, fileHeader := range headers {
+		file, err := fileHeader.Open()
+		if err != nil {
+			closeInputs(inputs)
+			return nil, errors.New("Could not read file.")
+		}
+		inputs = append(inputs, &jobInput{
+			Kind:     kind,
+			Params:   params,
+			FileName: fileHeader.Filename,
+			MimeType: fileHeader.Header.Get("Content-Type"),
+			Size:     fileHeader.Size,
+			Body:     file,
+		})
+	}
+	return inputs, nil
+}
+
+// Returns inputs of every file of JSON batch, files are decoded by jobInput.load
+func batchInputsFromJSON(c *gin.Context, maxFiles int) ([]*jobInput, error) {
+	var call BatchCall
+	if err := c.ShouldBindJSON(&call); err != nil {
+		return nil, errors.New("Could not parse request.")
+	}
+	if len(call.Files) == 0 {
+		return nil, errors.New("No file is received.")
+	}
+	if len(call.Files) > maxFiles {
+		return nil, tooManyFilesError(maxFiles)
+	}
+	params := call.Params
+	if params == nil {
+		params = make(map[string]string)
+	}
+	inputs := make([]*jobInput, 0, len(call.Files))
+	for i, payload := range call.Files {
+		var fileName string
+		if i < len(call.FileNames) {
+			fileName = call.FileNames[i]
+		}
+		inputs = append(inputs, &jobInput{
+			Kind:     call.Kind,
+			Params:   params,
+			FileName: fileName,
+			payload:  payload,
+		})
+	}
+	return inputs, nil
+}
+
+func closeInputs(inputs []*jobInput) {
+	for _, in := range inputs {
+		in.close()
+	}
+}
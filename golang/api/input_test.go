@@ -0,0 +1,31 @@
+package api
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeBase64Payload(t *testing.T) {
+	raw := []byte("\x89PNG\r\n\x1a\nfoo?>")
+	data, mimeType, err := decodeBase64Payload(base64.StdEncoding.EncodeToString(raw))
+	require.Nil(t, err)
+	assert.Equal(t, raw, data)
+	assert.Equal(t, "", mimeType)
+
+	data, mimeType, err = decodeBase64Payload("data:image/png;base64," + base64.StdEncoding.EncodeToString(raw))
+	require.Nil(t, err)
+	assert.Equal(t, raw, data)
+	assert.Equal(t, "image/png", mimeType)
+
+	data, _, err = decodeBase64Payload(base64.RawURLEncoding.EncodeToString(raw))
+	require.Nil(t, err)
+	assert.Equal(t, raw, data)
+
+	_, _, err = decodeBase64Payload("data:image/png,foo")
+	assert.NotNil(t, err)
+	_, _, err = decodeBase64Payload("not base64 at all!")
+	assert.NotNil(t, err)
+}
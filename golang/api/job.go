@@ -1,128 +1,353 @@
 package api
 
 import (
-	"image"
-	"image/color"
+	"bytes"
+	"context"
+	"fmt"
 	"io"
-	"math"
-	"mime/multipart"
-	"os"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
 
 	"github.com/disintegration/imaging"
 )
 
-func putInSquare(img image.Image, size int) *image.NRGBA {
-	dst := imaging.New(size, size, color.RGBA{255, 255, 255, 0})
-	return imaging.Paste(dst, img, image.Pt(0, 0))
+func init() {
+	RegisterProcessor(NewProcessor(JOB_ORIG, processOrig))
+	RegisterProcessor(&squareProcessor{name: JOB_SQUARE_ORIG})
+	RegisterProcessor(&squareProcessor{name: JOB_SQUARE_SMALL, size: SquareSmallSize})
+	RegisterProcessor(resizeProcessor{})
+	RegisterProcessor(NewCompositeProcessor(JOB_ALL_THREE, JOB_ORIG, JOB_SQUARE_ORIG, JOB_SQUARE_SMALL))
 }
 
-func performJobAllThree(dbw *DBWorker, job *Job, mediaRoot string, fileHeader *multipart.FileHeader) error {
-	if err := performJobOrig(dbw, job, mediaRoot, fileHeader); err != nil {
-		return err
+// Keeps uploaded file as it is, with strip_metadata the file is stored without
+// metadata unless its EXIF orientation has to be applied to pixels instead.
+func processOrig(src *Source, params map[string]string) ([]*Output, error) {
+	op, err := parseOutputParams(params)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := performJobSquareOrig(dbw, job, mediaRoot, fileHeader); err != nil {
-		return err
+	if !op.StripMetadata || src.Upload == nil {
+		return []*Output{{Image: src.Image, Raw: true}}, nil
 	}
-
-	if err := performJobSquareSmall(dbw, job, mediaRoot, fileHeader); err != nil {
-		return err
+	file, err := src.Upload.Open()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if JPEGOrientation(data) != 1 {
+		// src is oriented already
+		return []*Output{{Image: src.Image}}, nil
+	}
+	stripped, err := StripMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	return []*Output{{Image: src.Image, Data: stripped}}, nil
 }
 
-func performJobSquareSmall(dbw *DBWorker, job *Job, mediaRoot string, fileHeader *multipart.FileHeader) error {
-	dbImg, err := NewImageFromForm(job, mediaRoot, fileHeader)
-	if err != nil {
-		return err
+// Images made by one processor of a job
+type leafResult struct {
+	images []*Image
+	// images whose files were written to storage for them
+	created []*Image
+	err     error
+}
+
+// Paths pinned by a job until its images are saved
+type jobPins struct {
+	mu       sync.Mutex
+	releases []func()
+}
+
+func (p *jobPins) pin(dbw *DBWorker, path string) {
+	release := dbw.PinImagePath(path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.releases = append(p.releases, release)
+}
+
+func (p *jobPins) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, release := range p.releases {
+		release()
 	}
+	p.releases = nil
+}
 
-	file, err := fileHeader.Open()
-	if err != nil {
-		return err
+// Runs processors of the job kind and saves their outputs. Outputs of deterministic
+// processors made earlier from the same content are reused, upload is decoded
+// once if some processor has to run and processors run concurrently.
+// Images of the job are saved in one transaction, files written for them
+// are removed when the job fails. Paths of the images are pinned until then,
+// so files found in storage are not removed by deletion of other images.
+// Panic of a processor or decoder fails the job. Image event is published
+// to events for every output once it is stored.
+func performJob(ctx context.Context, dbw *DBWorker, job *Job, storage Storage, upload *Upload, events *EventHub) (err error) {
+	defer recoverPanic(job, &err)
+	proc, ok := LookupProcessor(job.Kind)
+	if !ok {
+		return fmt.Errorf("Processor %s is not registered.", job.Kind)
 	}
-	defer file.Close()
-	src, err := imaging.Decode(file)
+	leaves, err := leafProcessors(proc)
 	if err != nil {
 		return err
 	}
-	res := imaging.Crop(src, image.Rect(0, 0, 256, 256))
-	b := res.Bounds()
-	if b.Max.X < 256 || b.Max.Y < 256 {
-		res = putInSquare(res, 256)
+	if upload.Digest == "" {
+		if upload.Digest, err = upload.Hash(); err != nil {
+			return err
+		}
 	}
-	if err := imaging.Save(res, dbImg.Path); err != nil {
-		return err
+	pins := &jobPins{}
+	defer pins.release()
+	results := make([]leafResult, len(leaves))
+	var pending []int
+	for i, leaf := range leaves {
+		img, err := reuseOutput(ctx, dbw, pins, job, storage, upload, leaf)
+		if err != nil {
+			return err
+		}
+		if img != nil {
+			results[i].images = []*Image{img}
+			events.Publish(outputEvent(job, img))
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if len(pending) > 0 {
+		src, err := decodeUpload(upload)
+		if err != nil {
+			return err
+		}
+		var wg sync.WaitGroup
+		for _, i := range pending {
+			wg.Add(1)
+			go func(res *leafResult, leaf Processor) {
+				defer wg.Done()
+				defer recoverPanic(job, &res.err)
+				res.images, res.created, res.err = runLeaf(ctx, dbw, pins, events, job, storage, src, leaf)
+			}(&results[i], leaves[i])
+		}
+		wg.Wait()
+	}
+	var images, created []*Image
+	for _, res := range results {
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+		images = append(images, res.images...)
+		created = append(created, res.created...)
+	}
+	// images are listed by id, it should follow the order of processors
+	for _, img := range images {
+		if err != nil {
+			break
+		}
+		img.ID, err = NewULIDNow()
+	}
+	if err == nil {
+		err = dbw.SaveNewImages(ctx, images)
 	}
-	stat, err := os.Stat(dbImg.Path)
 	if err != nil {
+		pins.release()
+		for _, img := range created {
+			removeImageFile(ctx, dbw, storage, img)
+		}
 		return err
 	}
-	dbImg.Width = 256
-	dbImg.Height = 256
-	dbImg.Size = int64(stat.Size())
-	return dbw.SaveNewImage(dbImg)
+	return nil
+}
+
+// Returns image event of output stored for the job, image is not saved yet
+func outputEvent(job *Job, img *Image) JobEvent {
+	return JobEvent{Type: JobEventImage, JobID: job.ID, ImageKind: img.Kind}
+}
+
+// Turns panic into error of the job, should be deferred
+func recoverPanic(job *Job, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	log.Printf("job %s panicked: %v\n%s", job.ID, r, debug.Stack())
+	*err = fmt.Errorf("Processing failed unexpectedly: %v", r)
 }
 
-func performJobSquareOrig(dbw *DBWorker, job *Job, mediaRoot string, fileHeader *multipart.FileHeader) error {
-	dbImg, err := NewImageFromForm(job, mediaRoot, fileHeader)
+// Runs processor and stores its outputs, images are returned unsaved
+func runLeaf(ctx context.Context, dbw *DBWorker, pins *jobPins, events *EventHub, job *Job, storage Storage, src *Source, leaf Processor) ([]*Image, []*Image, error) {
+	var images, created []*Image
+	outputs, err := leaf.Process(src, job.Params)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	for _, out := range outputs {
+		img, written, err := storeOutput(ctx, dbw, pins, job, storage, src.Upload, out)
+		if err != nil {
+			return images, created, err
+		}
+		images = append(images, img)
+		events.Publish(outputEvent(job, img))
+		if written {
+			created = append(created, img)
+		}
 	}
+	return images, created, nil
+}
 
-	file, err := fileHeader.Open()
+func decodeUpload(upload *Upload) (*Source, error) {
+	file, err := upload.Open()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer file.Close()
-	src, err := imaging.Decode(file)
+	img, err := imaging.Decode(file, imaging.AutoOrientation(true))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	b := src.Bounds()
-	size := math.Max(float64(b.Max.X), float64(b.Max.Y))
-	dbImg.Width = int(size)
-	dbImg.Height = int(size)
-	img := putInSquare(src, int(size))
-	if err := imaging.Save(img, dbImg.Path); err != nil {
-		return err
+	return &Source{Image: img, Upload: upload}, nil
+}
+
+// Expands composite processors into processors they consist of
+func leafProcessors(proc Processor) ([]Processor, error) {
+	composite, ok := proc.(*compositeProcessor)
+	if !ok {
+		return []Processor{proc}, nil
 	}
-	stat, err := os.Stat(dbImg.Path)
+	members, err := composite.lookupMembers()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var leaves []Processor
+	for _, member := range members {
+		expanded, err := leafProcessors(member)
+		if err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, expanded...)
 	}
-	dbImg.Size = int64(stat.Size())
-	return dbw.SaveNewImage(dbImg)
+	return leaves, nil
 }
 
-func performJobOrig(dbw *DBWorker, job *Job, mediaRoot string, fileHeader *multipart.FileHeader) error {
-	dbImg, err := NewImageFromForm(job, mediaRoot, fileHeader)
+func isDeterministic(proc Processor) bool {
+	d, ok := proc.(Deterministic)
+	return ok && d.Deterministic()
+}
+
+// Returns unsaved image of the job pointing to output made by proc earlier
+// from the same content, nil if there is no such output
+func reuseOutput(ctx context.Context, dbw *DBWorker, pins *jobPins, job *Job, storage Storage, upload *Upload, proc Processor) (*Image, error) {
+	if upload.Digest == "" || !isDeterministic(proc) {
+		return nil, nil
+	}
+	var prev Image
+	err := dbw.LoadDerivedImage(ctx, &prev, upload.Digest, proc.Name(), job.Params)
+	if IsNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+	pins.pin(dbw, prev.Path)
+	if _, err := storage.Stat(ctx, prev.Path); IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
+	img := prev
+	img.JobID = job.ID
+	img.UserID = job.UserID
+	return &img, nil
+}
+
+// Returns storage key of content with the digest, extension tells its format
+func contentKey(digest, ext string) string {
+	return digest + strings.ToLower(ext)
+}
 
-	file, err := fileHeader.Open()
+// Writes output to storage unless the same content is there already and returns
+// its unsaved image, bool tells whether the file was written for it.
+// Digest of the upload should be known.
+func storeOutput(ctx context.Context, dbw *DBWorker, pins *jobPins, job *Job, storage Storage, upload *Upload, out *Output) (*Image, bool, error) {
+	op, err := parseOutputParams(job.Params)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-	defer file.Close()
-	src, err := imaging.Decode(file)
+	dbImg, err := NewImageFromUpload(job, upload)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-	b := src.Bounds()
-	dbImg.Width = b.Max.X
-	dbImg.Height = b.Max.Y
-
-	out, err := os.Create(dbImg.Path)
+	dbImg.Kind = out.Kind
+	if dbImg.Kind == "" {
+		dbImg.Kind = job.Kind
+	}
+	dbImg.SourceDigest = upload.Digest
+	b := out.Image.Bounds()
+	dbImg.Width = b.Dx()
+	dbImg.Height = b.Dy()
+	var content io.Reader
+	if out.Data != nil && op.keepsRaw(upload) {
+		content = bytes.NewReader(out.Data)
+		dbImg.Digest = sha256Hex(out.Data)
+		dbImg.Path = contentKey(dbImg.Digest, filepath.Ext(upload.FileName))
+	} else if out.Raw && op.keepsRaw(upload) {
+		file, err := upload.Open()
+		if err != nil {
+			return nil, false, err
+		}
+		defer file.Close()
+		content = file
+		dbImg.Digest = upload.Digest
+		dbImg.Path = contentKey(dbImg.Digest, filepath.Ext(upload.FileName))
+	} else {
+		format, err := op.formatFor(upload)
+		if err != nil {
+			return nil, false, err
+		}
+		var buf bytes.Buffer
+		if err := op.encode(&buf, out.Image, format); err != nil {
+			return nil, false, err
+		}
+		content = &buf
+		dbImg.Digest = sha256Hex(buf.Bytes())
+		dbImg.MimeType = format.MimeType
+		dbImg.Path = contentKey(dbImg.Digest, format.Exts[0])
+	}
+	pins.pin(dbw, dbImg.Path)
+	used, err := dbw.ImagePathUsed(ctx, dbImg.Path)
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+	if used {
+		// same content is stored already
+		info, err := storage.Stat(ctx, dbImg.Path)
+		if err == nil {
+			dbImg.Size = info.Size
+			return dbImg, false, nil
+		}
+		if !IsNotFound(err) {
+			return nil, false, err
+		}
 	}
-	defer out.Close()
-	file.Seek(0, io.SeekStart)
-	_, err = io.Copy(out, file)
+	size, err := storage.Put(ctx, dbImg.Path, content)
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+	dbImg.Size = size
+	return dbImg, true, nil
+}
+
+// Removes file of deleted image unless other images share it or a job
+// in progress is going to, missing file is not an error
+func removeImageFile(ctx context.Context, dbw *DBWorker, storage Storage, img *Image) {
+	if _, err := dbw.RemoveUnusedFile(ctx, storage, img.Path); err != nil {
+		log.Printf("could not remove %s of image %s: %s", img.Path, img.ID, err.Error())
 	}
-	return dbw.SaveNewImage(dbImg)
 }
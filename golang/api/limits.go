@@ -0,0 +1,128 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	DefaultMaxBodySize = 64 << 20
+	DefaultMaxFileSize = 50 << 20
+	// Decoded image of 50 megapixels takes 200MB as NRGBA
+	DefaultMaxPixels = 50000000
+
+	// Files of a batch are staged one by one, but JSON body is held whole
+	DefaultMaxBatchBodySize = 128 << 20
+	DefaultMaxBatchFiles    = 100
+)
+
+// Codes telling which limit upload exceeds, sent in error responses
+const (
+	ErrCodeBodyTooLarge  = "body_too_large"
+	ErrCodeFileTooLarge  = "file_too_large"
+	ErrCodeTooManyPixels = "too_many_pixels"
+)
+
+// Request body which refuses to be read past the limit
+type limitedBody struct {
+	io.ReadCloser
+	left     int64
+	exceeded bool
+}
+
+func newLimitedBody(body io.ReadCloser, limit int64) *limitedBody {
+	return &limitedBody{ReadCloser: body, left: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		// body ending exactly at the limit is fine
+		var one [1]byte
+		n, err := b.ReadCloser.Read(one[:])
+		if n == 0 {
+			return 0, err
+		}
+		b.exceeded = true
+		return 0, errors.New("Request body is larger than allowed.")
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+type TooManyPixelsError struct {
+	Width  int
+	Height int
+	Max    int64
+}
+
+func (err TooManyPixelsError) Error() string {
+	return fmt.Sprintf("Image %dx%d is too large, it may have at most %d pixels.", err.Width, err.Height, err.Max)
+}
+
+// Processor whose output size follows from its parameters and size of the source
+type outputSizer interface {
+	// Returns the largest width and height of outputs made with params from source
+	// of size src, src is empty when it is not known. Zero size means it can not tell.
+	OutputSize(params map[string]string, src image.Rectangle) (int, int, error)
+}
+
+// Checks that outputs of processor made with params from source of size src
+// do not exceed maxPixels, empty src checks what parameters alone tell
+func checkOutputPixels(proc Processor, params map[string]string, src image.Rectangle, maxPixels int64) error {
+	leaves, err := leafProcessors(proc)
+	if err != nil {
+		return err
+	}
+	for _, leaf := range leaves {
+		sizer, ok := leaf.(outputSizer)
+		if !ok {
+			continue
+		}
+		w, h, err := sizer.OutputSize(params, src)
+		if err != nil {
+			return err
+		}
+		if int64(w)*int64(h) > maxPixels {
+			return TooManyPixelsError{Width: w, Height: h, Max: maxPixels}
+		}
+	}
+	return nil
+}
+
+// Part of JPEG file read for its EXIF orientation, APP1 segment is at most 64KB
+const orientationHeadSize = 128 << 10
+
+// Reads dimensions from image header of the upload and checks them against maxPixels.
+// Returns bounds of the upload as it is decoded, with EXIF orientation applied.
+// Uploads which can not be decoded are let through with empty bounds, their jobs fail later.
+func checkUploadPixels(upload *Upload, maxPixels int64) (image.Rectangle, error) {
+	file, err := upload.Open()
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	defer file.Close()
+	head, err := ioutil.ReadAll(io.LimitReader(file, orientationHeadSize))
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	cfg, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), file))
+	if err != nil {
+		return image.Rectangle{}, nil
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxPixels {
+		return image.Rectangle{}, TooManyPixelsError{Width: cfg.Width, Height: cfg.Height, Max: maxPixels}
+	}
+	if JPEGOrientation(head) >= 5 {
+		// rotated by 90 degrees
+		return image.Rect(0, 0, cfg.Height, cfg.Width), nil
+	}
+	return image.Rect(0, 0, cfg.Width, cfg.Height), nil
+}
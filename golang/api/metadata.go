@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errMalformedImage = errors.New("Malformed image file.")
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// JPEG segments carrying EXIF and XMP (APP1), ICC profile (APP2) and IPTC (APP13)
+var jpegMetadataMarkers = map[byte]bool{0xe1: true, 0xe2: true, 0xed: true}
+
+// PNG chunks carrying EXIF, ICC profile and text
+var pngMetadataChunks = map[string]bool{"eXIf": true, "iCCP": true, "tEXt": true, "zTXt": true, "iTXt": true}
+
+// Returns copy of JPEG or PNG data without EXIF, XMP, ICC and text metadata,
+// data of other formats is returned as it is.
+func StripMetadata(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		return stripJPEG(data)
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		return stripPNG(data)
+	}
+	return data, nil
+}
+
+// Calls fn for every JPEG segment before image data with its marker and
+// payload, rest of the file from the start of scan is not visited.
+// Returns offset of the start of scan.
+func walkJPEG(data []byte, fn func(marker byte, start, end int)) (int, error) {
+	pos := 2
+	for {
+		if pos+2 > len(data) || data[pos] != 0xff {
+			return 0, errMalformedImage
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// fill byte
+			pos++
+			continue
+		}
+		if marker == 0xd9 || marker == 0xda {
+			return pos, nil
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			fn(marker, pos, pos+2)
+			pos += 2
+			continue
+		}
+		if pos+4 > len(data) {
+			return 0, errMalformedImage
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) || end < pos+4 {
+			return 0, errMalformedImage
+		}
+		fn(marker, pos, end)
+		pos = end
+	}
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	scan, err := walkJPEG(data, func(marker byte, start, end int) {
+		if !jpegMetadataMarkers[marker] {
+			out = append(out, data[start:end]...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(out, data[scan:]...), nil
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, errMalformedImage
+		}
+		// length, type, data and crc
+		end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+		if end > len(data) || end < pos+12 {
+			return nil, errMalformedImage
+		}
+		if !pngMetadataChunks[string(data[pos+4:pos+8])] {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	return out, nil
+}
+
+// Returns EXIF orientation of JPEG data, 1 when it is missing or malformed
+func JPEGOrientation(data []byte) int {
+	orientation := 1
+	if !bytes.HasPrefix(data, []byte("\xff\xd8")) {
+		return orientation
+	}
+	walkJPEG(data, func(marker byte, start, end int) {
+		if marker != 0xe1 {
+			return
+		}
+		payload := data[start+4 : end]
+		if bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			if o := exifOrientation(payload[6:]); o > 0 {
+				orientation = o
+			}
+		}
+	})
+	return orientation
+}
+
+// Reads orientation tag of the first IFD of TIFF structure, 0 if it is not there
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 0
+			}
+			return o
+		}
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pngChunk(kind string, data []byte) []byte {
+	chunk := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+func TestStripMetadataJPEG(t *testing.T) {
+	data, err := ioutil.ReadFile("test_data/rotated.jpg")
+	require.Nil(t, err)
+	assert.Equal(t, 6, JPEGOrientation(data))
+	stripped, err := StripMetadata(data)
+	require.Nil(t, err)
+	assert.Equal(t, 1, JPEGOrientation(stripped))
+	assert.False(t, bytes.Contains(stripped, []byte("Exif")))
+	assert.False(t, bytes.Contains(stripped, []byte("GPS")))
+	img, err := imaging.Decode(bytes.NewReader(stripped))
+	require.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 40, 20), img.Bounds())
+
+	_, err = StripMetadata(data[:30])
+	assert.NotNil(t, err)
+}
+
+func TestStripMetadataPNG(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, imaging.New(4, 4, red)))
+	clean := buf.Bytes()
+	// text chunk right after IHDR
+	ihdrEnd := len(pngSignature) + 25
+	var data []byte
+	data = append(data, clean[:ihdrEnd]...)
+	data = append(data, pngChunk("tEXt", []byte("Comment\x00secret"))...)
+	data = append(data, clean[ihdrEnd:]...)
+	_, err := png.Decode(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	stripped, err := StripMetadata(data)
+	require.Nil(t, err)
+	assert.Equal(t, clean, stripped)
+	_, err = StripMetadata(data[:ihdrEnd+6])
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Versioned change of the database schema
+type Migration struct {
+	Version int
+	Name    string
+	// SQL statements separated by semicolons
+	Up string
+	// Optional data migration run after Up in the same transaction
+	Func func(tx *sqlx.Tx) error
+}
+
+// Migration with the time it was applied, if it was
+type MigrationState struct {
+	Migration *Migration
+	AppliedAt sql.NullTime
+}
+
+func (s *MigrationState) Applied() bool {
+	return s.AppliedAt.Valid
+}
+
+const schemaMigrationsTable = `create table if not exists schema_migrations (
+			version int primary key,
+			name text not null,
+			applied_at timestamp not null
+			)`
+
+// Returns migrations sorted by version
+func sortedMigrations() []*Migration {
+	sorted := make([]*Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+// Returns versions of applied migrations with times they were applied at.
+// Database is only read, every migration is pending if there is no table yet.
+func (dbw *DBWorker) appliedMigrations() (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+	var tables int
+	err := dbw.Get(&tables, "select count(*) from sqlite_master where type='table' and name='schema_migrations'")
+	if err != nil || tables == 0 {
+		return applied, err
+	}
+	var rows []struct {
+		Version   int
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	if err := dbw.Select(&rows, "select version, applied_at from schema_migrations"); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+// Lists all known migrations and tells which of them are applied
+func (dbw *DBWorker) MigrationStatus() ([]*MigrationState, error) {
+	applied, err := dbw.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var states []*MigrationState
+	for _, m := range sortedMigrations() {
+		state := &MigrationState{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			state.AppliedAt = sql.NullTime{Time: at, Valid: true}
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// Migrations not yet applied, in the order they would be applied
+func (dbw *DBWorker) PendingMigrations() ([]*Migration, error) {
+	states, err := dbw.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	var pending []*Migration
+	for _, s := range states {
+		if !s.Applied() {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Applies pending migrations each in its own transaction, returns applied ones
+func (dbw *DBWorker) Migrate() ([]*Migration, error) {
+	if err := dbw.WriteOne(schemaMigrationsTable); err != nil {
+		return nil, err
+	}
+	pending, err := dbw.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var done []*Migration
+	if len(pending) > 0 {
+		defer dbw.resetReaders()
+	}
+	for _, m := range pending {
+		if err := dbw.applyMigration(m); err != nil {
+			return done, fmt.Errorf("migration %d %s: %s", m.Version, m.Name, err.Error())
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+func (dbw *DBWorker) applyMigration(m *Migration) error {
+	dbw.mu.Lock()
+	defer dbw.mu.Unlock()
+	tx, err := dbw.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if m.Up != "" {
+		if _, err := tx.Exec(m.Up); err != nil {
+			return err
+		}
+	}
+	if m.Func != nil {
+		if err := m.Func(tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("insert into schema_migrations (version, name, applied_at) values (?,?,?)",
+		m.Version, m.Name, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
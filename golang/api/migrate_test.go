@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	dbw, err := testDBWorker()
+	require.Nil(t, err)
+	defer removeWorker(dbw)
+	pending, err := dbw.PendingMigrations()
+	require.Nil(t, err)
+	assert.Equal(t, len(migrations), len(pending))
+	states, err := dbw.MigrationStatus()
+	require.Nil(t, err)
+	assert.False(t, states[0].Applied())
+	// status does not change the database
+	var tables int
+	require.Nil(t, dbw.Get(&tables, "select count(*) from sqlite_master"))
+	assert.Equal(t, 0, tables)
+	applied, err := dbw.Migrate()
+	require.Nil(t, err)
+	assert.Equal(t, len(migrations), len(applied))
+	pending, err = dbw.PendingMigrations()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(pending))
+	applied, err = dbw.Migrate()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(applied))
+	states, err = dbw.MigrationStatus()
+	require.Nil(t, err)
+	for i, s := range states {
+		assert.True(t, s.Applied())
+		assert.Equal(t, i+1, s.Migration.Version)
+	}
+}
+
+// Database created by CreateTables before migrations existed
+func TestMigrateLegacy(t *testing.T) {
+	dbw, err := testDBWorker()
+	require.Nil(t, err)
+	defer removeWorker(dbw)
+	_, err = dbw.DB.Exec(migrations[0].Up)
+	require.Nil(t, err)
+	require.Nil(t, dbw.WriteOne("insert into users (id, username, password, token) values (?,?,?,?)",
+		"foo", "foo", "hash", "footoken"))
+	// reader connection caches schema of version 1
+	var count int
+	require.Nil(t, dbw.Get(&count, "select count(*) from jobs"))
+	tm := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	jobID, _ := NewULID(tm)
+	require.Nil(t, dbw.WriteOne("insert into jobs (id, user_id, state, kind) values (?,?,?,?)",
+		jobID, "foo", JobStateDone, JOB_ORIG))
+
+	_, err = dbw.Migrate()
+	require.Nil(t, err)
+	var job Job
+	require.Nil(t, dbw.LoadJob(context.Background(), &job, jobID))
+	assert.True(t, tm.Equal(job.CreatedAt))
+	assert.Equal(t, "", job.Error)
+}
+
+func TestMigrateTokens(t *testing.T) {
+	dbw, err := testDBWorker()
+	require.Nil(t, err)
+	defer removeWorker(dbw)
+	_, err = dbw.DB.Exec(migrations[0].Up)
+	require.Nil(t, err)
+	require.Nil(t, dbw.WriteOne("insert into users (id, username, password, token) values (?,?,?,?)",
+		"foo", "foo", "hash", "footoken"))
+	_, err = dbw.Migrate()
+	require.Nil(t, err)
+	// plain tokens are dropped when tokens get hashed
+	var token AuthToken
+	err = dbw.LoadAuthToken(context.Background(), &token, "footoken", []byte("secret"))
+	assert.True(t, IsNotFound(err))
+	var count int
+	require.Nil(t, dbw.Get(&count, "select count(*) from tokens"))
+	assert.Equal(t, 0, count)
+	var user User
+	require.Nil(t, dbw.LoadUser(context.Background(), &user, "foo"))
+	assert.Equal(t, "hash", user.Password)
+}
+
+func TestMigrateImageKind(t *testing.T) {
+	dbw, err := testDBWorker()
+	require.Nil(t, err)
+	defer removeWorker(dbw)
+	_, err = dbw.DB.Exec(migrations[0].Up)
+	require.Nil(t, err)
+	require.Nil(t, dbw.WriteOne("insert into users (id, username, password, token) values (?,?,?,?)",
+		"foo", "foo", "hash", "footoken"))
+	insertJob := "insert into jobs (id, user_id, state, kind) values (?,?,?,?)"
+	insertImage := `insert into images (id, user_id, job_id, path, mime_type, size, width, height)
+		values (?,'foo',?,?,'image/png',1,1,1)`
+	require.Nil(t, dbw.WriteOne(insertJob, "job1", "foo", JobStateDone, JOB_SQUARE_SMALL))
+	require.Nil(t, dbw.WriteOne(insertImage, "img0", "job1", "/tmp/img0"))
+	require.Nil(t, dbw.WriteOne(insertJob, "job2", "foo", JobStateDone, JOB_ALL_THREE))
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("img%d", i)
+		require.Nil(t, dbw.WriteOne(insertImage, id, "job2", "/tmp/"+id))
+	}
+	_, err = dbw.Migrate()
+	require.Nil(t, err)
+	var kinds []string
+	require.Nil(t, dbw.Select(&kinds, "select kind from images order by id"))
+	assert.Equal(t, []string{JOB_SQUARE_SMALL, JOB_ORIG, JOB_SQUARE_ORIG, JOB_SQUARE_SMALL}, kinds)
+}
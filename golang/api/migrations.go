@@ -0,0 +1,240 @@
+package api
+
+import (
+	"github.com/jmoiron/sqlx"
+	ulid "github.com/oklog/ulid/v2"
+)
+
+// Schema history, append new migrations to the end and never edit applied ones.
+// Tables of databases created before migrations existed match version 1,
+// that is why it does not fail on existing tables.
+var migrations = []*Migration{
+	{
+		Version: 1,
+		Name:    "initial",
+		Up: `create table if not exists users (
+				id text primary key,
+				username text unique not null,
+				password text not null,
+				token text unique not null);
+			create table if not exists jobs (
+				id text primary key,
+				user_id text not null,
+				state int not null,
+				kind text not null,
+				foreign key (user_id)
+					references users (id)
+				);
+			create table if not exists images (
+				id text primary key,
+				user_id text not null,
+				job_id text not null,
+				path text unique not null,
+				mime_type text not null,
+				size int not null,
+				width int not null,
+				height int not null,
+				foreign key (user_id)
+					references users (id),
+				foreign key (job_id)
+					references jobs (id)
+				)`,
+	},
+	{
+		Version: 2,
+		Name:    "invite codes",
+		Up: `create table if not exists invite_codes (
+				code text primary key,
+				created_at timestamp not null,
+				used_by text,
+				used_at timestamp,
+				foreign key (used_by)
+					references users (id)
+				)`,
+	},
+	{
+		Version: 3,
+		Name:    "job errors and timestamps",
+		Up: `alter table jobs add column error text not null default '';
+			alter table jobs add column created_at timestamp not null default '1970-01-01 00:00:00';
+			alter table jobs add column started_at timestamp;
+			alter table jobs add column finished_at timestamp`,
+		Func: backfillJobCreatedAt,
+	},
+	{
+		Version: 4,
+		Name:    "auth tokens",
+		Up: `create table tokens (
+				id text primary key,
+				user_id text not null,
+				key text unique not null,
+				created_at timestamp not null,
+				expires_at timestamp,
+				last_used_at timestamp,
+				revoked_at timestamp,
+				foreign key (user_id)
+					references users (id)
+				);
+			create index tokens_user_id on tokens (user_id);
+			insert into tokens (id, user_id, key, created_at)
+				select lower(hex(randomblob(16))), id, token, datetime('now') from users;
+			create table users_new (
+				id text primary key,
+				username text unique not null,
+				password text not null);
+			insert into users_new (id, username, password)
+				select id, username, password from users;
+			drop table users;
+			alter table users_new rename to users`,
+	},
+	{
+		Version: 5,
+		Name:    "hashed tokens",
+		// Plain tokens can not be hashed without the secret,
+		// they are dropped and users have to log in again.
+		Up: `drop table tokens;
+			create table tokens (
+				id text primary key,
+				user_id text not null,
+				prefix text not null,
+				hash text unique not null,
+				created_at timestamp not null,
+				expires_at timestamp,
+				last_used_at timestamp,
+				revoked_at timestamp,
+				foreign key (user_id)
+					references users (id)
+				);
+			create index tokens_user_id on tokens (user_id);
+			create index tokens_prefix on tokens (prefix)`,
+	},
+	{
+		Version: 6,
+		Name:    "job listing indexes",
+		Up: `create index jobs_user_id on jobs (user_id, id);
+			create index images_job_id on images (job_id)`,
+	},
+	{
+		Version: 7,
+		Name:    "image kind",
+		Up: `alter table images add column kind text not null default '';
+			create index images_user_id on images (user_id, id)`,
+		Func: backfillImageKind,
+	},
+	{
+		Version: 8,
+		Name:    "content addressed images",
+		// images with the same content share path, so it is not unique anymore
+		Up: `create table images_new (
+				id text primary key,
+				user_id text not null,
+				job_id text not null,
+				path text not null,
+				mime_type text not null,
+				size int not null,
+				width int not null,
+				height int not null,
+				kind text not null default '',
+				digest text not null default '',
+				source_digest text not null default '',
+				foreign key (user_id)
+					references users (id),
+				foreign key (job_id)
+					references jobs (id)
+				);
+			insert into images_new (id, user_id, job_id, path, mime_type, size, width, height, kind)
+				select id, user_id, job_id, path, mime_type, size, width, height, kind from images;
+			drop table images;
+			alter table images_new rename to images;
+			create index images_job_id on images (job_id);
+			create index images_user_id on images (user_id, id);
+			create index images_path on images (path);
+			create index images_source_digest on images (source_digest, kind)`,
+	},
+	{
+		Version: 9,
+		Name:    "job params",
+		Up:      `alter table jobs add column params text not null default '{}'`,
+	},
+	{
+		Version: 10,
+		Name:    "centered squares",
+		// square outputs made before are top-left aligned, they must not be reused
+		Up: `update images set source_digest=''
+			where kind in ('square_original', 'square_small')`,
+	},
+	{
+		Version: 11,
+		Name:    "oriented outputs",
+		// derived outputs made before ignore EXIF orientation, they must not be reused
+		Up: `update images set source_digest='' where kind != 'original'`,
+	},
+	{
+		Version: 12,
+		Name:    "batches",
+		Up: `create table batches (
+				id text primary key,
+				user_id text not null,
+				kind text not null,
+				params text not null default '{}',
+				created_at timestamp not null,
+				foreign key (user_id)
+					references users (id)
+				);
+			alter table jobs add column batch_id text not null default '';
+			create index jobs_batch_id on jobs (batch_id)`,
+	},
+	{
+		Version: 13,
+		Name:    "job instances",
+		Up:      `alter table jobs add column instance text not null default ''`,
+	},
+}
+
+// Images of single kind jobs get kind of the job. Jobs of all_three kind
+// saved original, square_original and square_small images in this order.
+func backfillImageKind(tx *sqlx.Tx) error {
+	var jobs []struct {
+		ID   string
+		Kind string
+	}
+	if err := tx.Select(&jobs, "select id, kind from jobs"); err != nil {
+		return err
+	}
+	allThree := []string{"original", "square_original", "square_small"}
+	for _, job := range jobs {
+		var ids []string
+		if err := tx.Select(&ids, "select id from images where job_id=? order by id", job.ID); err != nil {
+			return err
+		}
+		for i, id := range ids {
+			kind := job.Kind
+			if job.Kind == "all_three" && len(ids) == len(allThree) {
+				kind = allThree[i]
+			}
+			if _, err := tx.Exec("update images set kind=? where id=?", kind, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Job IDs are ULIDs, so creation time of existing jobs is known
+func backfillJobCreatedAt(tx *sqlx.Tx) error {
+	var ids []string
+	if err := tx.Select(&ids, "select id from jobs"); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		parsed, err := ulid.Parse(id)
+		if err != nil {
+			continue
+		}
+		createdAt := ulid.Time(parsed.Time()).UTC()
+		if _, err := tx.Exec("update jobs set created_at=? where id=?", createdAt, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
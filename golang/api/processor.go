@@ -0,0 +1,178 @@
+package api
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+)
+
+// Input of a processor
+type Source struct {
+	// Decoded upload
+	Image image.Image
+	// Uploaded file as it was received
+	Upload *Upload
+}
+
+// Result of a processor to be stored as a job image
+type Output struct {
+	Image image.Image
+	// Store uploaded file byte to byte instead of encoding Image,
+	// Image still defines dimensions of the output.
+	Raw bool
+	// Content to store instead of encoding Image, it is in the format of the upload
+	Data []byte
+	// Name of the processor which made the output,
+	// kind of the job is used when it is empty.
+	Kind string
+}
+
+// Processor produces images for jobs of its kind
+type Processor interface {
+	// Job kind handled by processor
+	Name() string
+	// Checks job parameters before the job is accepted
+	Validate(params map[string]string) error
+	// Makes one or more outputs from the source image
+	Process(src *Source, params map[string]string) ([]*Output, error)
+}
+
+// Implemented by processors whose outputs depend only on the source and parameters,
+// outputs made earlier from the same content are reused instead of processing it again.
+type Deterministic interface {
+	Deterministic() bool
+}
+
+type ProcessFunc func(src *Source, params map[string]string) ([]*Output, error)
+
+type funcProcessor struct {
+	name          string
+	fn            ProcessFunc
+	deterministic bool
+}
+
+// Returns processor that accepts any parameters and calls fn
+func NewProcessor(name string, fn ProcessFunc) Processor {
+	return &funcProcessor{name: name, fn: fn}
+}
+
+// Same as NewProcessor for fn always making the same outputs from the same source
+func NewDeterministicProcessor(name string, fn ProcessFunc) Processor {
+	return &funcProcessor{name: name, fn: fn, deterministic: true}
+}
+
+func (p *funcProcessor) Deterministic() bool {
+	return p.deterministic
+}
+
+func (p *funcProcessor) Name() string {
+	return p.name
+}
+
+func (p *funcProcessor) Validate(params map[string]string) error {
+	return nil
+}
+
+func (p *funcProcessor) Process(src *Source, params map[string]string) ([]*Output, error) {
+	outputs, err := p.fn(src, params)
+	for _, out := range outputs {
+		if out.Kind == "" {
+			out.Kind = p.name
+		}
+	}
+	return outputs, err
+}
+
+// Runs registered processors one by one and joins their outputs
+type compositeProcessor struct {
+	name    string
+	members []string
+}
+
+// Returns processor combining processors registered under members names
+func NewCompositeProcessor(name string, members ...string) Processor {
+	return &compositeProcessor{name: name, members: members}
+}
+
+func (p *compositeProcessor) Name() string {
+	return p.name
+}
+
+func (p *compositeProcessor) lookupMembers() ([]Processor, error) {
+	procs := make([]Processor, 0, len(p.members))
+	for _, name := range p.members {
+		proc, ok := LookupProcessor(name)
+		if !ok {
+			return nil, fmt.Errorf("Processor %s is not registered.", name)
+		}
+		procs = append(procs, proc)
+	}
+	return procs, nil
+}
+
+func (p *compositeProcessor) Validate(params map[string]string) error {
+	procs, err := p.lookupMembers()
+	if err != nil {
+		return err
+	}
+	for _, proc := range procs {
+		if err := proc.Validate(params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *compositeProcessor) Process(src *Source, params map[string]string) ([]*Output, error) {
+	procs, err := p.lookupMembers()
+	if err != nil {
+		return nil, err
+	}
+	var outputs []*Output
+	for _, proc := range procs {
+		outs, err := proc.Process(src, params)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, outs...)
+	}
+	return outputs, nil
+}
+
+var (
+	processorsMu sync.RWMutex
+	processors   = make(map[string]Processor)
+)
+
+// Makes processor available as a job kind, panics if the kind is taken
+func RegisterProcessor(p Processor) {
+	processorsMu.Lock()
+	defer processorsMu.Unlock()
+	if p == nil {
+		panic("api: RegisterProcessor processor is nil")
+	}
+	if _, dup := processors[p.Name()]; dup {
+		panic("api: RegisterProcessor called twice for " + p.Name())
+	}
+	processors[p.Name()] = p
+}
+
+func LookupProcessor(name string) (Processor, bool) {
+	processorsMu.RLock()
+	defer processorsMu.RUnlock()
+	p, ok := processors[name]
+	return p, ok
+}
+
+// Sorted names of registered processors
+func ProcessorNames() []string {
+	processorsMu.RLock()
+	defer processorsMu.RUnlock()
+	names := make([]string, 0, len(processors))
+	for name := range processors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
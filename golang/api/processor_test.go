@@ -0,0 +1,75 @@
+package api
+
+import (
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type flipProcessor struct{}
+
+func (p flipProcessor) Name() string {
+	return "test_flip"
+}
+
+func (p flipProcessor) Validate(params map[string]string) error {
+	if params["axis"] != "h" && params["axis"] != "v" {
+		return errors.New("Wrong axis.")
+	}
+	return nil
+}
+
+func (p flipProcessor) Process(src *Source, params map[string]string) ([]*Output, error) {
+	if params["axis"] == "h" {
+		return []*Output{{Image: imaging.FlipH(src.Image)}}, nil
+	}
+	return []*Output{{Image: imaging.FlipV(src.Image)}}, nil
+}
+
+func init() {
+	RegisterProcessor(flipProcessor{})
+	RegisterProcessor(NewCompositeProcessor("test_orig_flip", JOB_ORIG, "test_flip"))
+}
+
+func TestProcessorRegistry(t *testing.T) {
+	proc, ok := LookupProcessor(JOB_ALL_THREE)
+	require.True(t, ok)
+	assert.Equal(t, JOB_ALL_THREE, proc.Name())
+	_, ok = LookupProcessor("dummy")
+	assert.False(t, ok)
+	assert.Contains(t, ProcessorNames(), "test_flip")
+	assert.Panics(t, func() { RegisterProcessor(flipProcessor{}) })
+	_, err := NewJob("foo", "test_flip")
+	assert.Nil(t, err)
+	_, err = NewJob("foo", "dummy")
+	assert.NotNil(t, err)
+}
+
+func TestCompositeProcessor(t *testing.T) {
+	src := &Source{Image: imaging.New(30, 20, image.White.C)}
+	proc, _ := LookupProcessor("test_orig_flip")
+	assert.NotNil(t, proc.Validate(map[string]string{}))
+	assert.Nil(t, proc.Validate(map[string]string{"axis": "h"}))
+	outs, err := proc.Process(src, map[string]string{"axis": "h"})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(outs))
+	assert.True(t, outs[0].Raw)
+	assert.False(t, outs[1].Raw)
+	assert.Equal(t, JOB_ORIG, outs[0].Kind)
+
+	proc, _ = LookupProcessor(JOB_ALL_THREE)
+	outs, err = proc.Process(src, nil)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(outs))
+	assert.Equal(t, 30, outs[1].Image.Bounds().Dx())
+	assert.Equal(t, 30, outs[1].Image.Bounds().Dy())
+	assert.Equal(t, 256, outs[2].Image.Bounds().Dx())
+
+	broken := NewCompositeProcessor("test_broken", JOB_ORIG, "dummy")
+	_, err = broken.Process(src, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,340 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	StagingDirName   = "staging"
+	DefaultQueueSize = 100
+)
+
+var DefaultWorkers = runtime.NumCPU()
+
+var ErrQueueFull = errors.New("Job queue is full, try again later.")
+var ErrQueueStopped = errors.New("Job queue is stopped.")
+var ErrJobInterrupted = errors.New("Job was interrupted by server restart.")
+
+// Uploaded file kept in staging area until a worker performs its job
+type Upload struct {
+	Path     string
+	FileName string
+	MimeType string
+	Size     int64
+	// Hex encoded SHA-256 of the content
+	Digest string
+}
+
+func (u *Upload) Open() (*os.File, error) {
+	return os.Open(u.Path)
+}
+
+func (u *Upload) Remove() error {
+	return os.Remove(u.Path)
+}
+
+// Returns hex encoded SHA-256 of the content
+func (u *Upload) Hash() (string, error) {
+	file, err := u.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Directory where uploads wait for workers
+func StagingDir(mediaRoot string) string {
+	return filepath.Join(mediaRoot, StagingDirName)
+}
+
+// Copies r into staging area of mediaRoot under the name bound to the job
+func StageUpload(job *Job, mediaRoot, fileName, mimeType string, r io.Reader) (*Upload, error) {
+	_, fileName = filepath.Split(fileName)
+	upload := &Upload{
+		Path:     filepath.Join(StagingDir(mediaRoot), fmt.Sprintf("%s_%s", job.ID, fileName)),
+		FileName: fileName,
+		MimeType: mimeType,
+	}
+	out, err := os.Create(upload.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), r)
+	if err != nil {
+		os.Remove(upload.Path)
+		return nil, err
+	}
+	upload.Size = n
+	upload.Digest = hex.EncodeToString(h.Sum(nil))
+	return upload, nil
+}
+
+type jobTask struct {
+	job    *Job
+	upload *Upload
+}
+
+// Pool of goroutines performing jobs in background
+type JobQueue struct {
+	dbw     *DBWorker
+	storage Storage
+	workers int
+	tasks   chan *jobTask
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	started bool
+	stopped bool
+	// Slots held by reservations, guarded by mu
+	reserved int
+	// Receives events of queued jobs
+	Events *EventHub
+}
+
+// Returns queue saving images of performed jobs into storage
+func NewJobQueue(dbw *DBWorker, storage Storage, workers, size int) *JobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &JobQueue{
+		dbw:     dbw,
+		storage: storage,
+		workers: workers,
+		tasks:   make(chan *jobTask, size),
+		Events:  NewEventHub(),
+	}
+}
+
+// Launches workers, does nothing if they are already running
+func (q *JobQueue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started || q.stopped {
+		return
+	}
+	q.started = true
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.run()
+	}
+}
+
+// Stops accepting jobs and waits for queued ones to be performed
+func (q *JobQueue) Stop() {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return
+	}
+	q.stopped = true
+	close(q.tasks)
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// Puts job into queue without blocking, returns ErrQueueFull if there is no room
+// apart from slots held by reservations
+func (q *JobQueue) Enqueue(job *Job, upload *Upload) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return ErrQueueStopped
+	}
+	if len(q.tasks)+q.reserved >= cap(q.tasks) {
+		return ErrQueueFull
+	}
+	return q.push(job, upload)
+}
+
+// Sends task to workers, q.mu should be held
+func (q *JobQueue) push(job *Job, upload *Upload) error {
+	select {
+	case q.tasks <- &jobTask{job: job, upload: upload}:
+		q.Events.Publish(JobEvent{Type: JobEventQueued, JobID: job.ID})
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Puts job into queue waiting for room, workers should be running
+func (q *JobQueue) requeue(job *Job, upload *Upload) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return ErrQueueStopped
+	}
+	q.tasks <- &jobTask{job: job, upload: upload}
+	q.Events.Publish(JobEvent{Type: JobEventQueued, JobID: job.ID})
+	return nil
+}
+
+// Slots of the queue held for jobs which are not saved yet
+type QueueReservation struct {
+	q    *JobQueue
+	left int
+}
+
+// Holds n slots of the queue, so that all n jobs can be enqueued later
+// or none of them is. Returns ErrQueueFull if there is not enough room.
+func (q *JobQueue) Reserve(n int) (*QueueReservation, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return nil, ErrQueueStopped
+	}
+	if cap(q.tasks)-len(q.tasks)-q.reserved < n {
+		return nil, ErrQueueFull
+	}
+	q.reserved += n
+	return &QueueReservation{q: q, left: n}, nil
+}
+
+// Puts job into one of reserved slots
+func (r *QueueReservation) Enqueue(job *Job, upload *Upload) error {
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+	if r.left == 0 {
+		return ErrQueueFull
+	}
+	r.left--
+	r.q.reserved--
+	if r.q.stopped {
+		return ErrQueueStopped
+	}
+	return r.q.push(job, upload)
+}
+
+// Gives slots not used yet back to the queue
+func (r *QueueReservation) Release() {
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+	r.q.reserved -= r.left
+	r.left = 0
+}
+
+func (q *JobQueue) run() {
+	defer q.wg.Done()
+	for task := range q.tasks {
+		q.perform(task)
+	}
+}
+
+func (q *JobQueue) perform(task *jobTask) {
+	ctx := context.Background()
+	job := task.job
+	defer task.upload.Remove()
+	job.Start()
+	if err := q.dbw.SaveJob(ctx, job); err != nil {
+		log.Printf("could not save job %s: %s", job.ID, err.Error())
+	}
+	q.Events.Publish(JobEvent{Type: JobEventStarted, JobID: job.ID})
+	err := performJob(ctx, q.dbw, job, q.storage, task.upload, q.Events)
+	if err != nil {
+		log.Printf("job %s failed: %s", job.ID, err.Error())
+	}
+	job.Finish(err)
+	if err := q.dbw.SaveJob(ctx, job); err != nil {
+		log.Printf("could not save job %s: %s", job.ID, err.Error())
+	}
+	q.publishResult(ctx, job)
+}
+
+// Publishes final state of finished job, its images were told as they were stored
+func (q *JobQueue) publishResult(ctx context.Context, job *Job) {
+	var imgs []Image
+	if job.State == JobStateDone {
+		var err error
+		if imgs, err = q.dbw.JobImages(ctx, job.ID); err != nil {
+			log.Printf("could not fetch images of job %s: %s", job.ID, err.Error())
+		}
+	}
+	events := finishedJobEvents(job, imgs)
+	q.Events.Publish(events[len(events)-1])
+}
+
+// Picks up jobs left unfinished by previous run, should be called before new jobs
+// are accepted. Jobs whose uploads are still staged are queued again, the rest fail.
+// Staged files of no unfinished job are removed. Workers are started, so that
+// every job fits into the queue however many of them there are. Only jobs of the
+// instance are recovered, jobs of other instances sharing the database go on.
+func (q *JobQueue) Recover(ctx context.Context, instance, mediaRoot string) (requeued, failed int, err error) {
+	jobs, err := q.dbw.UnfinishedJobs(ctx, instance)
+	if err != nil {
+		return 0, 0, err
+	}
+	q.Start()
+	entries, err := ioutil.ReadDir(StagingDir(mediaRoot))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	staged := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		staged[entry.Name()] = filepath.Join(StagingDir(mediaRoot), entry.Name())
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		upload := findStagedUpload(staged, job.ID)
+		if upload != nil {
+			delete(staged, filepath.Base(upload.Path))
+			job.StartedAt = sql.NullTime{}
+			if err = q.dbw.SaveJob(ctx, job); err != nil {
+				return requeued, failed, err
+			}
+			if err := q.requeue(job, upload); err == nil {
+				requeued++
+				continue
+			}
+			upload.Remove()
+		}
+		job.Finish(ErrJobInterrupted)
+		if err = q.dbw.SaveJob(ctx, job); err != nil {
+			return requeued, failed, err
+		}
+		failed++
+	}
+	for _, path := range staged {
+		if err := os.Remove(path); err != nil {
+			log.Printf("could not remove staged %s: %s", path, err.Error())
+		}
+	}
+	return requeued, failed, nil
+}
+
+// Returns upload staged for the job among staged files by their names
+func findStagedUpload(staged map[string]string, jobID string) *Upload {
+	prefix := jobID + "_"
+	for name, path := range staged {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		upload := &Upload{Path: path, FileName: strings.TrimPrefix(name, prefix)}
+		if format := LookupImageFormat(strings.TrimPrefix(filepath.Ext(name), ".")); format != nil {
+			upload.MimeType = format.MimeType
+		}
+		if info, err := os.Stat(path); err == nil {
+			upload.Size = info.Size()
+		}
+		return upload
+	}
+	return nil
+}
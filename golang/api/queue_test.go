@@ -0,0 +1,465 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueuePerform(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	require.Nil(t, os.MkdirAll(StagingDir("/tmp/foo"), os.ModePerm))
+	user, _ := createTestUser("foo", "bar", dbw)
+	q := NewJobQueue(dbw, NewLocalStorage("/tmp/foo"), 2, 10)
+	q.Start()
+
+	file, err := os.Open("test_data/img.png")
+	require.Nil(t, err)
+	defer file.Close()
+	good, _ := NewJob(user.ID, JOB_ORIG)
+	require.Nil(t, dbw.SaveNewJob(context.Background(), good))
+	goodUpload, err := StageUpload(good, "/tmp/foo", "img.png", "image/png", file)
+	require.Nil(t, err)
+	require.Nil(t, q.Enqueue(good, goodUpload))
+
+	bad, _ := NewJob(user.ID, JOB_SQUARE_SMALL)
+	require.Nil(t, dbw.SaveNewJob(context.Background(), bad))
+	badUpload, err := StageUpload(bad, "/tmp/foo", "img.png", "image/png", bytes.NewBufferString("not an image"))
+	require.Nil(t, err)
+	require.Nil(t, q.Enqueue(bad, badUpload))
+
+	q.Stop()
+	assert.Equal(t, ErrQueueStopped, q.Enqueue(good, goodUpload))
+	var job Job
+	require.Nil(t, dbw.LoadJob(context.Background(), &job, good.ID))
+	assert.Equal(t, int64(JobStateDone), job.State)
+	require.Nil(t, dbw.LoadJob(context.Background(), &job, bad.ID))
+	assert.Equal(t, int64(JobStateFailed), job.State)
+	assert.NotEqual(t, "", job.Error)
+	assert.True(t, job.FinishedAt.Valid)
+	_, err = os.Stat(goodUpload.Path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(badUpload.Path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestQueueFull(t *testing.T) {
+	q := NewJobQueue(nil, NewLocalStorage("/tmp/foo"), 1, 1)
+	job := &Job{ID: "foo"}
+	assert.Nil(t, q.Enqueue(job, &Upload{}))
+	assert.Equal(t, ErrQueueFull, q.Enqueue(job, &Upload{}))
+}
+
+func TestQueueReserve(t *testing.T) {
+	q := NewJobQueue(nil, NewLocalStorage("/tmp/foo"), 1, 3)
+	job := &Job{ID: "foo"}
+	_, err := q.Reserve(4)
+	assert.Equal(t, ErrQueueFull, err)
+	r, err := q.Reserve(2)
+	require.Nil(t, err)
+	// reserved slots are not taken by other jobs
+	assert.Nil(t, q.Enqueue(job, &Upload{}))
+	assert.Equal(t, ErrQueueFull, q.Enqueue(job, &Upload{}))
+	_, err = q.Reserve(1)
+	assert.Equal(t, ErrQueueFull, err)
+	assert.Nil(t, r.Enqueue(job, &Upload{}))
+	// unused slot is given back
+	r.Release()
+	assert.Equal(t, ErrQueueFull, r.Enqueue(job, &Upload{}))
+	assert.Nil(t, q.Enqueue(job, &Upload{}))
+	assert.Equal(t, 3, len(q.tasks))
+
+	q.Stop()
+	_, err = q.Reserve(1)
+	assert.Equal(t, ErrQueueStopped, err)
+}
+
+func TestPerformJobReuse(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	require.Nil(t, os.MkdirAll(StagingDir("/tmp/foo"), os.ModePerm))
+	storage := NewLocalStorage("/tmp/foo")
+	ctx := context.Background()
+	user, _ := createTestUser("foo", "bar", dbw)
+
+	file, err := os.Open("test_data/img.png")
+	require.Nil(t, err)
+	defer file.Close()
+	first, _ := NewJob(user.ID, JOB_SQUARE_SMALL)
+	require.Nil(t, dbw.SaveNewJob(ctx, first))
+	upload, err := StageUpload(first, "/tmp/foo", "img.png", "image/png", file)
+	require.Nil(t, err)
+	defer upload.Remove()
+	require.Nil(t, performJob(ctx, dbw, first, storage, upload, nil))
+
+	// content is not decoded again for deterministic kinds
+	second, _ := NewJob(user.ID, JOB_SQUARE_SMALL)
+	require.Nil(t, dbw.SaveNewJob(ctx, second))
+	broken, err := StageUpload(second, "/tmp/foo", "img.png", "image/png", bytes.NewBufferString("not an image"))
+	require.Nil(t, err)
+	defer broken.Remove()
+	broken.Digest = upload.Digest
+	require.Nil(t, performJob(ctx, dbw, second, storage, broken, nil))
+	imgs, err := dbw.JobImages(ctx, second.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(imgs))
+	assert.Equal(t, 256, imgs[0].Width)
+
+	third, _ := NewJob(user.ID, JOB_SQUARE_ORIG)
+	require.Nil(t, dbw.SaveNewJob(ctx, third))
+	assert.NotNil(t, performJob(ctx, dbw, third, storage, broken, nil))
+}
+
+func init() {
+	RegisterProcessor(NewProcessor("test_fail", func(src *Source, params map[string]string) ([]*Output, error) {
+		return nil, errors.New("Processing failed.")
+	}))
+	RegisterProcessor(NewCompositeProcessor("test_square_fail", JOB_SQUARE_ORIG, JOB_SQUARE_SMALL, "test_fail"))
+	RegisterProcessor(NewProcessor("test_panic", func(src *Source, params map[string]string) ([]*Output, error) {
+		panic("processor bug")
+	}))
+	RegisterProcessor(NewCompositeProcessor("test_square_panic", JOB_SQUARE_ORIG, "test_panic"))
+}
+
+func TestPerformJobAtomic(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	require.Nil(t, os.MkdirAll(StagingDir(mediaRoot), os.ModePerm))
+	storage := NewLocalStorage(mediaRoot)
+	ctx := context.Background()
+	user, _ := createTestUser("foo", "bar", dbw)
+	stored := func() []string {
+		objects, err := storage.List(ctx, "")
+		require.Nil(t, err)
+		var keys []string
+		for _, obj := range objects {
+			if !strings.HasPrefix(obj.Key, StagingDirName) {
+				keys = append(keys, obj.Key)
+			}
+		}
+		return keys
+	}
+
+	file, err := os.Open("test_data/img.png")
+	require.Nil(t, err)
+	defer file.Close()
+	failed, _ := NewJob(user.ID, "test_square_fail")
+	require.Nil(t, dbw.SaveNewJob(ctx, failed))
+	upload, err := StageUpload(failed, mediaRoot, "img.png", "image/png", file)
+	require.Nil(t, err)
+	defer upload.Remove()
+	err = performJob(ctx, dbw, failed, storage, upload, nil)
+	require.NotNil(t, err)
+	assert.Equal(t, "Processing failed.", err.Error())
+	imgs, err := dbw.JobImages(ctx, failed.ID)
+	require.Nil(t, err)
+	assert.Empty(t, imgs)
+	assert.Empty(t, stored())
+
+	job, _ := NewJob(user.ID, JOB_ALL_THREE)
+	require.Nil(t, dbw.SaveNewJob(ctx, job))
+	hub := NewEventHub()
+	events, unsubscribe := hub.Subscribe(job.ID)
+	defer unsubscribe()
+	require.Nil(t, performJob(ctx, dbw, job, storage, upload, hub))
+	imgs, err = dbw.JobImages(ctx, job.ID)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(imgs))
+	// every output is told once it is stored, before images get ids
+	var kinds []string
+	for i := 0; i < 3; i++ {
+		e := <-events
+		assert.Equal(t, JobEventImage, e.Type)
+		assert.Empty(t, e.ImageID)
+		kinds = append(kinds, e.ImageKind)
+	}
+	assert.ElementsMatch(t, []string{JOB_ORIG, JOB_SQUARE_ORIG, JOB_SQUARE_SMALL}, kinds)
+	assert.Equal(t, []string{JOB_ORIG, JOB_SQUARE_ORIG, JOB_SQUARE_SMALL},
+		[]string{imgs[0].Kind, imgs[1].Kind, imgs[2].Kind})
+	assert.Equal(t, 3, len(stored()))
+}
+
+func TestPerformJobPanic(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	require.Nil(t, os.MkdirAll(StagingDir(mediaRoot), os.ModePerm))
+	storage := NewLocalStorage(mediaRoot)
+	ctx := context.Background()
+	user, _ := createTestUser("foo", "bar", dbw)
+	q := NewJobQueue(dbw, storage, 1, 10)
+	q.Start()
+
+	var jobs []*Job
+	for _, kind := range []string{"test_panic", "test_square_panic"} {
+		file, err := os.Open("test_data/img.png")
+		require.Nil(t, err)
+		job, _ := NewJob(user.ID, kind)
+		require.Nil(t, dbw.SaveNewJob(ctx, job))
+		upload, err := StageUpload(job, mediaRoot, "img.png", "image/png", file)
+		file.Close()
+		require.Nil(t, err)
+		require.Nil(t, q.Enqueue(job, upload))
+		jobs = append(jobs, job)
+	}
+	q.Stop()
+	for _, job := range jobs {
+		require.Nil(t, dbw.LoadJob(ctx, job, job.ID))
+		assert.Equal(t, int64(JobStateFailed), job.State)
+		assert.Equal(t, "Processing failed unexpectedly: processor bug", job.Error)
+		imgs, err := dbw.JobImages(ctx, job.ID)
+		require.Nil(t, err)
+		assert.Empty(t, imgs)
+	}
+}
+
+func TestRemoveImageFileConcurrent(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	require.Nil(t, os.MkdirAll(StagingDir(mediaRoot), os.ModePerm))
+	storage := NewLocalStorage(mediaRoot)
+	ctx := context.Background()
+	user, _ := createTestUser("foo", "bar", dbw)
+
+	file, err := os.Open("test_data/img.png")
+	require.Nil(t, err)
+	defer file.Close()
+	first, _ := NewJob(user.ID, JOB_ORIG)
+	require.Nil(t, dbw.SaveNewJob(ctx, first))
+	upload, err := StageUpload(first, mediaRoot, "img.png", "image/png", file)
+	require.Nil(t, err)
+	defer upload.Remove()
+	require.Nil(t, performJob(ctx, dbw, first, storage, upload, nil))
+	imgs, err := dbw.JobImages(ctx, first.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(imgs))
+	path := imgs[0].Path
+
+	// pinned file is kept after the last image using it is deleted
+	release := dbw.PinImagePath(path)
+	require.Nil(t, dbw.DeleteImage(ctx, &imgs[0]))
+	removed, err := dbw.RemoveUnusedFile(ctx, storage, path)
+	require.Nil(t, err)
+	assert.False(t, removed)
+	release()
+	removed, err = dbw.RemoveUnusedFile(ctx, storage, path)
+	require.Nil(t, err)
+	assert.True(t, removed)
+
+	// images of the same content are saved while others are deleted
+	require.Nil(t, performJob(ctx, dbw, first, storage, upload, nil))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			imgs, err := dbw.JobImages(ctx, first.ID)
+			if !assert.Nil(t, err) {
+				return
+			}
+			for _, img := range imgs {
+				if assert.Nil(t, dbw.DeleteImage(ctx, &img)) {
+					removeImageFile(ctx, dbw, storage, &img)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, performJob(ctx, dbw, first, storage, upload, nil))
+		}()
+	}
+	wg.Wait()
+	require.Nil(t, performJob(ctx, dbw, first, storage, upload, nil))
+	imgs, err = dbw.JobImages(ctx, first.ID)
+	require.Nil(t, err)
+	require.NotEmpty(t, imgs)
+	for _, img := range imgs {
+		assert.Equal(t, path, img.Path)
+		assert.FileExists(t, filepath.Join(mediaRoot, img.Path))
+	}
+}
+
+// Storage whose Delete waits until release is closed
+type slowDeleteStorage struct {
+	Storage
+	deleting chan bool
+	release  chan struct{}
+}
+
+func (s *slowDeleteStorage) Delete(ctx context.Context, key string) error {
+	s.deleting <- true
+	<-s.release
+	return s.Storage.Delete(ctx, key)
+}
+
+func TestRemoveUnusedFileUnlocked(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	storage := &slowDeleteStorage{NewLocalStorage(mediaRoot), make(chan bool), make(chan struct{})}
+	ctx := context.Background()
+	user, _ := createTestUser("foo", "bar", dbw)
+	_, err = storage.Put(ctx, "foo.png", bytes.NewBufferString("foo"))
+	require.Nil(t, err)
+
+	removed := make(chan bool)
+	go func() {
+		ok, err := dbw.RemoveUnusedFile(ctx, storage, "foo.png")
+		assert.Nil(t, err)
+		removed <- ok
+	}()
+	<-storage.deleting
+	// writes go on while storage removes the file
+	job, _ := NewJob(user.ID, JOB_ORIG)
+	require.Nil(t, dbw.SaveNewJob(ctx, job))
+	ok, err := dbw.RemoveUnusedFile(ctx, storage, "foo.png")
+	require.Nil(t, err)
+	assert.False(t, ok)
+	// job pinning the path waits for the removal
+	pinned := make(chan func())
+	go func() {
+		pinned <- dbw.PinImagePath("foo.png")
+	}()
+	select {
+	case <-pinned:
+		t.Fatal("path was pinned while its file was being removed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(storage.release)
+	assert.True(t, <-removed)
+	release := <-pinned
+	assert.NoFileExists(t, filepath.Join(mediaRoot, "foo.png"))
+	release()
+}
+
+func TestQueueRecover(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	require.Nil(t, os.MkdirAll(StagingDir(mediaRoot), os.ModePerm))
+	ctx := context.Background()
+	user, _ := createTestUser("foo", "bar", dbw)
+
+	// running when the server stopped, its upload is still staged
+	staged, _ := NewJob(user.ID, JOB_ORIG)
+	staged.Start()
+	require.Nil(t, dbw.SaveNewJob(ctx, staged))
+	file, err := os.Open("test_data/img.png")
+	require.Nil(t, err)
+	defer file.Close()
+	upload, err := StageUpload(staged, mediaRoot, "img.png", "image/png", file)
+	require.Nil(t, err)
+	// upload is lost
+	lost, _ := NewJob(user.ID, JOB_ORIG)
+	require.Nil(t, dbw.SaveNewJob(ctx, lost))
+	done, _ := NewJob(user.ID, JOB_ORIG)
+	done.Finish(nil)
+	require.Nil(t, dbw.SaveNewJob(ctx, done))
+	// performed by another instance sharing the database
+	other, _ := NewJob(user.ID, JOB_ORIG)
+	other.Instance = "other"
+	require.Nil(t, dbw.SaveNewJob(ctx, other))
+	stale := filepath.Join(StagingDir(mediaRoot), "01STALE_img.png")
+	require.Nil(t, ioutil.WriteFile(stale, []byte("foo"), 0644))
+
+	q := NewJobQueue(dbw, NewLocalStorage(mediaRoot), 1, 10)
+	requeued, failed, err := q.Recover(ctx, "", mediaRoot)
+	require.Nil(t, err)
+	assert.Equal(t, 1, requeued)
+	assert.Equal(t, 1, failed)
+	assert.NoFileExists(t, stale)
+	q.Stop()
+
+	var job Job
+	require.Nil(t, dbw.LoadJob(ctx, &job, staged.ID))
+	assert.Equal(t, int64(JobStateDone), job.State)
+	imgs, err := dbw.JobImages(ctx, staged.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(imgs))
+	assert.Equal(t, "image/png", imgs[0].MimeType)
+	assert.NoFileExists(t, upload.Path)
+	require.Nil(t, dbw.LoadJob(ctx, &job, lost.ID))
+	assert.Equal(t, int64(JobStateFailed), job.State)
+	assert.Equal(t, ErrJobInterrupted.Error(), job.Error)
+	require.Nil(t, dbw.LoadJob(ctx, &job, done.ID))
+	assert.Equal(t, int64(JobStateDone), job.State)
+	require.Nil(t, dbw.LoadJob(ctx, &job, other.ID))
+	assert.Equal(t, int64(JobStateStarted), job.State)
+	assert.Equal(t, "other", job.Instance)
+}
+
+func TestQueueRecoverMany(t *testing.T) {
+	dbw, err := testDBWorker()
+	defer removeWorker(dbw)
+	require.Nil(t, err)
+	require.Nil(t, dbw.CreateTables())
+	mediaRoot, err := ioutil.TempDir("", "media")
+	require.Nil(t, err)
+	defer os.RemoveAll(mediaRoot)
+	require.Nil(t, os.MkdirAll(StagingDir(mediaRoot), os.ModePerm))
+	ctx := context.Background()
+	user, _ := createTestUser("foo", "bar", dbw)
+
+	// more unfinished jobs than the queue holds
+	var jobs []*Job
+	for i := 0; i < 5; i++ {
+		job, _ := NewJob(user.ID, JOB_ORIG)
+		require.Nil(t, dbw.SaveNewJob(ctx, job))
+		file, err := os.Open("test_data/img.png")
+		require.Nil(t, err)
+		_, err = StageUpload(job, mediaRoot, "img.png", "image/png", file)
+		file.Close()
+		require.Nil(t, err)
+		jobs = append(jobs, job)
+	}
+	q := NewJobQueue(dbw, NewLocalStorage(mediaRoot), 1, 1)
+	requeued, failed, err := q.Recover(ctx, "", mediaRoot)
+	require.Nil(t, err)
+	assert.Equal(t, 5, requeued)
+	assert.Equal(t, 0, failed)
+	q.Stop()
+	for _, job := range jobs {
+		require.Nil(t, dbw.LoadJob(ctx, job, job.ID))
+		assert.Equal(t, int64(JobStateDone), job.State)
+	}
+	staged, err := ioutil.ReadDir(StagingDir(mediaRoot))
+	require.Nil(t, err)
+	assert.Empty(t, staged)
+}
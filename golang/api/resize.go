@@ -0,0 +1,218 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Largest width or height resize produces
+const MaxResizeSize = 8192
+
+const (
+	ResizeFit     = "fit"
+	ResizeFill    = "fill"
+	ResizePad     = "pad"
+	ResizeStretch = "stretch"
+)
+
+var resizeModes = []string{ResizeFit, ResizeFill, ResizePad, ResizeStretch}
+
+// Resampling filters by the names accepted in filter parameter
+var ResizeFilters = map[string]imaging.ResampleFilter{
+	"nearest":    imaging.NearestNeighbor,
+	"box":        imaging.Box,
+	"linear":     imaging.Linear,
+	"mitchell":   imaging.MitchellNetravali,
+	"catmullrom": imaging.CatmullRom,
+	"gaussian":   imaging.Gaussian,
+	"lanczos":    imaging.Lanczos,
+}
+
+const DefaultResizeFilter = "lanczos"
+
+type resizeParams struct {
+	Width      int
+	Height     int
+	Mode       string
+	Filter     imaging.ResampleFilter
+	Background color.NRGBA
+}
+
+// Parses color like ffffff or ffffff80
+func parseHexColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	b, err := hex.DecodeString(s)
+	if err != nil || (len(b) != 3 && len(b) != 4) {
+		return color.NRGBA{}, fmt.Errorf("Wrong color %s, use rrggbb or rrggbbaa.", s)
+	}
+	c := color.NRGBA{R: b[0], G: b[1], B: b[2], A: 255}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+	return c, nil
+}
+
+func parseSize(params map[string]string, name string) (int, error) {
+	value := params[name]
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > MaxResizeSize {
+		return 0, fmt.Errorf("Wrong %s, it should be a number from 1 to %d.", name, MaxResizeSize)
+	}
+	return n, nil
+}
+
+func filterNames() string {
+	names := make([]string, 0, len(ResizeFilters))
+	for name := range ResizeFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func parseResizeParams(params map[string]string) (*resizeParams, error) {
+	p := &resizeParams{Mode: params["mode"], Background: color.NRGBA{255, 255, 255, 255}}
+	var err error
+	if p.Width, err = parseSize(params, "width"); err != nil {
+		return nil, err
+	}
+	if p.Height, err = parseSize(params, "height"); err != nil {
+		return nil, err
+	}
+	if p.Mode == "" {
+		p.Mode = ResizeFit
+	}
+	switch p.Mode {
+	case ResizeFit, ResizeStretch:
+		if p.Width == 0 && p.Height == 0 {
+			return nil, errors.New("Width or height is required.")
+		}
+	case ResizeFill, ResizePad:
+		if p.Width == 0 || p.Height == 0 {
+			return nil, errors.New("Width and height are required.")
+		}
+	default:
+		return nil, fmt.Errorf("Wrong mode, allowed modes are %s.", strings.Join(resizeModes, ", "))
+	}
+	filter := params["filter"]
+	if filter == "" {
+		filter = DefaultResizeFilter
+	}
+	var ok bool
+	if p.Filter, ok = ResizeFilters[filter]; !ok {
+		return nil, fmt.Errorf("Wrong filter, allowed filters are %s.", filterNames())
+	}
+	if bg := params["background"]; bg != "" {
+		if p.Background, err = parseHexColor(bg); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Returns the largest size output may have, missing width or height
+// is limited by MaxResizeSize
+func (p *resizeParams) maxSize() (int, int) {
+	w, h := p.Width, p.Height
+	if w == 0 {
+		w = MaxResizeSize
+	}
+	if h == 0 {
+		h = MaxResizeSize
+	}
+	return w, h
+}
+
+// Returns size of the largest image with proportions of b fitting into width and height,
+// zero width or height does not limit the size.
+func fitSize(b image.Rectangle, width, height int) (int, int) {
+	scale := math.Inf(1)
+	if width > 0 {
+		scale = float64(width) / float64(b.Dx())
+	}
+	if height > 0 {
+		scale = math.Min(scale, float64(height)/float64(b.Dy()))
+	}
+	w := int(math.Max(1, math.Round(float64(b.Dx())*scale)))
+	h := int(math.Max(1, math.Round(float64(b.Dy())*scale)))
+	return w, h
+}
+
+// Resizes image to the size given in params with one of modes:
+// fit keeps proportions inside the size, fill covers the size and crops the rest,
+// pad fits and fills the rest with background, stretch ignores proportions.
+type resizeProcessor struct{}
+
+func (p resizeProcessor) Name() string {
+	return JOB_RESIZE
+}
+
+func (p resizeProcessor) Validate(params map[string]string) error {
+	_, err := parseResizeParams(params)
+	return err
+}
+
+// Returns size of output made from image of size b
+func (p *resizeParams) outputSize(b image.Rectangle) (int, int) {
+	switch {
+	case p.Mode == ResizeFill || p.Mode == ResizePad:
+		return p.Width, p.Height
+	case p.Mode == ResizeStretch && p.Width > 0 && p.Height > 0:
+		return p.Width, p.Height
+	}
+	// proportions are kept
+	w, h := p.maxSize()
+	return fitSize(b, w, h)
+}
+
+func (p resizeProcessor) OutputSize(params map[string]string, src image.Rectangle) (int, int, error) {
+	rp, err := parseResizeParams(params)
+	if err != nil {
+		return 0, 0, err
+	}
+	if src.Empty() {
+		if rp.Width == 0 || rp.Height == 0 {
+			return 0, 0, nil
+		}
+		// fit output is not larger than that
+		return rp.Width, rp.Height, nil
+	}
+	w, h := rp.outputSize(src)
+	return w, h, nil
+}
+
+func (p resizeProcessor) Deterministic() bool {
+	return true
+}
+
+func (p resizeProcessor) Process(src *Source, params map[string]string) ([]*Output, error) {
+	rp, err := parseResizeParams(params)
+	if err != nil {
+		return nil, err
+	}
+	var res *image.NRGBA
+	switch rp.Mode {
+	case ResizeFit, ResizeStretch:
+		w, h := rp.outputSize(src.Image.Bounds())
+		res = imaging.Resize(src.Image, w, h, rp.Filter)
+	case ResizeFill:
+		res = imaging.Fill(src.Image, rp.Width, rp.Height, imaging.Center, rp.Filter)
+	case ResizePad:
+		w, h := fitSize(src.Image.Bounds(), rp.Width, rp.Height)
+		fitted := imaging.Resize(src.Image, w, h, rp.Filter)
+		res = imaging.PasteCenter(imaging.New(rp.Width, rp.Height, rp.Background), fitted)
+	}
+	return []*Output{{Image: res, Kind: JOB_RESIZE}}, nil
+}
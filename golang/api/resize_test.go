@@ -0,0 +1,89 @@
+package api
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizeValidate(t *testing.T) {
+	proc, ok := LookupProcessor(JOB_RESIZE)
+	require.True(t, ok)
+	assert.NotNil(t, proc.Validate(map[string]string{}))
+	assert.NotNil(t, proc.Validate(map[string]string{"width": "foo"}))
+	assert.NotNil(t, proc.Validate(map[string]string{"width": "100000"}))
+	assert.NotNil(t, proc.Validate(map[string]string{"width": "0", "height": "100"}))
+	assert.NotNil(t, proc.Validate(map[string]string{"width": "100", "mode": "fill"}))
+	assert.NotNil(t, proc.Validate(map[string]string{"width": "100", "mode": "dummy"}))
+	assert.NotNil(t, proc.Validate(map[string]string{"width": "100", "filter": "dummy"}))
+	assert.NotNil(t, proc.Validate(map[string]string{"width": "100", "height": "50", "mode": "pad", "background": "fff"}))
+	assert.Nil(t, proc.Validate(map[string]string{"width": "100"}))
+	assert.Nil(t, proc.Validate(map[string]string{"width": "100", "height": "50", "mode": "pad", "background": "#00ff0080"}))
+	assert.Nil(t, proc.Validate(map[string]string{"height": "50", "mode": "stretch", "filter": "nearest"}))
+}
+
+func TestResizeProcess(t *testing.T) {
+	src := &Source{Image: imaging.New(200, 100, color.NRGBA{255, 0, 0, 255})}
+	proc, _ := LookupProcessor(JOB_RESIZE)
+	cases := []struct {
+		params map[string]string
+		width  int
+		height int
+	}{
+		{map[string]string{"width": "100"}, 100, 50},
+		{map[string]string{"width": "400", "height": "400"}, 400, 200},
+		{map[string]string{"height": "25"}, 50, 25},
+		{map[string]string{"width": "50", "height": "50", "mode": "fill"}, 50, 50},
+		{map[string]string{"width": "50", "height": "50", "mode": "pad"}, 50, 50},
+		{map[string]string{"width": "50", "height": "70", "mode": "stretch"}, 50, 70},
+	}
+	for _, c := range cases {
+		outs, err := proc.Process(src, c.params)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(outs))
+		assert.Equal(t, image.Rect(0, 0, c.width, c.height), outs[0].Image.Bounds(), c.params)
+		assert.Equal(t, JOB_RESIZE, outs[0].Kind)
+	}
+
+	// missing size does not let output grow past MaxResizeSize
+	tall := &Source{Image: imaging.New(1, 100, color.NRGBA{255, 0, 0, 255})}
+	for _, mode := range []string{ResizeFit, ResizeStretch} {
+		outs, err := proc.Process(tall, map[string]string{"width": "200", "mode": mode})
+		require.Nil(t, err)
+		assert.Equal(t, image.Rect(0, 0, 82, MaxResizeSize), outs[0].Image.Bounds(), mode)
+	}
+
+	outs, _ := proc.Process(src, map[string]string{"width": "50", "height": "50", "mode": "pad", "background": "0000ff"})
+	assert.Equal(t, color.NRGBA{0, 0, 255, 255}, color.NRGBAModel.Convert(outs[0].Image.At(25, 2)))
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, color.NRGBAModel.Convert(outs[0].Image.At(25, 25)))
+}
+
+func TestResizeOutputPixels(t *testing.T) {
+	proc, _ := LookupProcessor(JOB_RESIZE)
+	var unknown image.Rectangle
+	check := func(params map[string]string, src image.Rectangle, maxPixels int64) error {
+		return checkOutputPixels(proc, params, src, maxPixels)
+	}
+	assert.Nil(t, check(map[string]string{"width": "100", "height": "100", "mode": "pad"}, unknown, 10000))
+	err := check(map[string]string{"width": "101", "height": "100", "mode": "pad"}, unknown, 10000)
+	assert.Equal(t, TooManyPixelsError{Width: 101, Height: 100, Max: 10000}, err)
+	// missing height is not known until size of the source is
+	assert.Nil(t, check(map[string]string{"width": "6200"}, unknown, 10000))
+	assert.Nil(t, check(map[string]string{"width": "6200"}, image.Rect(0, 0, 6200, 1), 10000))
+	err = check(map[string]string{"width": "6200", "mode": "stretch"}, image.Rect(0, 0, 100, 100), 10000)
+	assert.Equal(t, TooManyPixelsError{Width: 6200, Height: 6200, Max: 10000}, err)
+	// fit into width and height does not grow past the source proportions
+	assert.Nil(t, check(map[string]string{"width": "8000", "height": "8000"}, image.Rect(0, 0, 8000, 1), 10000))
+	assert.NotNil(t, check(map[string]string{"width": "8000", "height": "8000", "mode": "pad"}, image.Rect(0, 0, 8000, 1), 10000))
+	// size of the source is taken after EXIF orientation
+	bounds, err := checkUploadPixels(&Upload{Path: "test_data/rotated.jpg"}, DefaultMaxPixels)
+	require.Nil(t, err)
+	assert.Equal(t, image.Rect(0, 0, 20, 40), bounds)
+	// processors without known output size are not checked
+	square, _ := LookupProcessor(JOB_SQUARE_SMALL)
+	assert.Nil(t, checkOutputPixels(square, map[string]string{}, image.Rect(0, 0, 10, 10), 1))
+}
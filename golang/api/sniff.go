@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Number of leading bytes enough to recognize any supported format
+const sniffLen = 16
+
+// Image format recognized by its magic bytes
+type ImageFormat struct {
+	MimeType string
+	// Known file extensions, the first one is used for new files
+	Exts []string
+	// Encoder used for outputs in the format
+	Encoding imaging.Format
+	magic    [][]byte
+}
+
+// Formats accepted for upload, all of them are decodable by imaging
+var ImageFormats = []*ImageFormat{
+	{MimeType: "image/jpeg", Exts: []string{".jpg", ".jpeg", ".jpe", ".jfif"},
+		Encoding: imaging.JPEG,
+		magic:    [][]byte{[]byte("\xff\xd8\xff")}},
+	{MimeType: "image/png", Exts: []string{".png"},
+		Encoding: imaging.PNG,
+		magic:    [][]byte{[]byte("\x89PNG\r\n\x1a\n")}},
+	{MimeType: "image/gif", Exts: []string{".gif"},
+		Encoding: imaging.GIF,
+		magic:    [][]byte{[]byte("GIF87a"), []byte("GIF89a")}},
+	{MimeType: "image/bmp", Exts: []string{".bmp"},
+		Encoding: imaging.BMP,
+		magic:    [][]byte{[]byte("BM")}},
+	{MimeType: "image/tiff", Exts: []string{".tif", ".tiff"},
+		Encoding: imaging.TIFF,
+		magic:    [][]byte{[]byte("II*\x00"), []byte("MM\x00*")}},
+}
+
+// Alternative names clients use for accepted formats
+var mimeAliases = map[string]string{
+	"image/jpg":      "image/jpeg",
+	"image/pjpeg":    "image/jpeg",
+	"image/x-png":    "image/png",
+	"image/x-bmp":    "image/bmp",
+	"image/x-ms-bmp": "image/bmp",
+}
+
+// Declared types that do not tell anything about content
+var genericMimeTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+}
+
+type UnsupportedFormatError struct{}
+
+func (err UnsupportedFormatError) Error() string {
+	names := make([]string, 0, len(ImageFormats))
+	for _, f := range ImageFormats {
+		names = append(names, f.Name())
+	}
+	return fmt.Sprintf("Unsupported file format, allowed formats are %s.", strings.Join(names, ", "))
+}
+
+func IsUnsupportedFormat(err error) bool {
+	_, ok := err.(UnsupportedFormatError)
+	return ok
+}
+
+// Returns format of data by its leading bytes or nil if it is not supported
+func SniffImageFormat(head []byte) *ImageFormat {
+	for _, f := range ImageFormats {
+		for _, magic := range f.magic {
+			if bytes.HasPrefix(head, magic) {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// Short name of the format like png
+func (f *ImageFormat) Name() string {
+	return strings.TrimPrefix(f.MimeType, "image/")
+}
+
+// Returns format by its short name or extension without dot, nil if it is not supported
+func LookupImageFormat(name string) *ImageFormat {
+	name = strings.ToLower(name)
+	for _, f := range ImageFormats {
+		if f.Name() == name || f.HasExt("."+name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (f *ImageFormat) HasExt(ext string) bool {
+	ext = strings.ToLower(ext)
+	for _, e := range f.Exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces extension of fileName if it does not belong to the format
+func (f *ImageFormat) FixFileName(fileName string) string {
+	ext := filepath.Ext(fileName)
+	if f.HasExt(ext) {
+		return fileName
+	}
+	return strings.TrimSuffix(fileName, ext) + f.Exts[0]
+}
+
+func normalizeMimeType(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(mimeType))
+	}
+	if alias, ok := mimeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// Detects format of the content read from r and checks it against declared type.
+// Returned reader yields the whole content including sniffed bytes.
+func DetectImageFormat(r io.Reader, declared string) (*ImageFormat, io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	format := SniffImageFormat(head)
+	if format == nil {
+		return nil, nil, UnsupportedFormatError{}
+	}
+	declared = normalizeMimeType(declared)
+	if !genericMimeTypes[declared] && declared != format.MimeType {
+		return nil, nil, fmt.Errorf("Declared type %s does not match file content %s.", declared, format.MimeType)
+	}
+	return format, br, nil
+}
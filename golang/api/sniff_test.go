@@ -0,0 +1,54 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffImageFormat(t *testing.T) {
+	assert.Equal(t, "image/png", SniffImageFormat([]byte("\x89PNG\r\n\x1a\n....")).MimeType)
+	assert.Equal(t, "image/jpeg", SniffImageFormat([]byte("\xff\xd8\xff\xe0")).MimeType)
+	assert.Equal(t, "image/gif", SniffImageFormat([]byte("GIF89a")).MimeType)
+	assert.Equal(t, "image/tiff", SniffImageFormat([]byte("MM\x00*")).MimeType)
+	assert.Nil(t, SniffImageFormat([]byte("<html>")))
+	assert.Nil(t, SniffImageFormat([]byte{}))
+}
+
+func TestDetectImageFormat(t *testing.T) {
+	file, err := os.Open("test_data/img.png")
+	require.Nil(t, err)
+	defer file.Close()
+	format, r, err := DetectImageFormat(file, "image/x-png")
+	require.Nil(t, err)
+	assert.Equal(t, "image/png", format.MimeType)
+	data, err := ioutil.ReadAll(r)
+	require.Nil(t, err)
+	assert.Equal(t, 167314, len(data))
+
+	_, _, err = DetectImageFormat(bytes.NewReader(data), "")
+	assert.Nil(t, err)
+	_, _, err = DetectImageFormat(bytes.NewReader(data), "image/gif")
+	assert.NotNil(t, err)
+	assert.False(t, IsUnsupportedFormat(err))
+	_, _, err = DetectImageFormat(bytes.NewBufferString("<html>"), "image/png")
+	assert.True(t, IsUnsupportedFormat(err))
+}
+
+func TestImageFormatFixFileName(t *testing.T) {
+	jpeg := SniffImageFormat([]byte("\xff\xd8\xff"))
+	assert.Equal(t, "foo.JPEG", jpeg.FixFileName("foo.JPEG"))
+	assert.Equal(t, "foo.jpg", jpeg.FixFileName("foo.png"))
+	assert.Equal(t, "foo.jpg", jpeg.FixFileName("foo"))
+}
+
+func TestLookupImageFormat(t *testing.T) {
+	assert.Equal(t, "image/jpeg", LookupImageFormat("jpeg").MimeType)
+	assert.Equal(t, "image/jpeg", LookupImageFormat("JPG").MimeType)
+	assert.Equal(t, "image/tiff", LookupImageFormat("tif").MimeType)
+	assert.Nil(t, LookupImageFormat("webp"))
+}
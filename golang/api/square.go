@@ -0,0 +1,144 @@
+package api
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Side of square_small outputs
+const SquareSmallSize = 256
+
+const (
+	// Whole image is scaled down to fit into the square, the rest is background
+	SquareFit = "fit"
+	// Square is cut out of the image
+	SquareCrop = "crop"
+)
+
+// Where the image is placed in the square or which part of it is kept by crop,
+// x and y are 0 for left or top, 1 for center and 2 for right or bottom
+type gravity struct {
+	anchor imaging.Anchor
+	x, y   int
+}
+
+var gravities = map[string]gravity{
+	"center":      {imaging.Center, 1, 1},
+	"top":         {imaging.Top, 1, 0},
+	"bottom":      {imaging.Bottom, 1, 2},
+	"left":        {imaging.Left, 0, 1},
+	"right":       {imaging.Right, 2, 1},
+	"topleft":     {imaging.TopLeft, 0, 0},
+	"topright":    {imaging.TopRight, 2, 0},
+	"bottomleft":  {imaging.BottomLeft, 0, 2},
+	"bottomright": {imaging.BottomRight, 2, 2},
+}
+
+type squareParams struct {
+	Mode       string
+	Gravity    gravity
+	Background color.NRGBA
+}
+
+func gravityNames() string {
+	names := make([]string, 0, len(gravities))
+	for name := range gravities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func parseSquareParams(params map[string]string) (*squareParams, error) {
+	p := &squareParams{
+		Mode:       params["square"],
+		Gravity:    gravities["center"],
+		Background: color.NRGBA{255, 255, 255, 255},
+	}
+	if p.Mode == "" {
+		p.Mode = SquareFit
+	}
+	if p.Mode != SquareFit && p.Mode != SquareCrop {
+		return nil, fmt.Errorf("Wrong square mode, allowed modes are %s, %s.", SquareFit, SquareCrop)
+	}
+	if name := params["gravity"]; name != "" {
+		g, ok := gravities[name]
+		if !ok {
+			return nil, fmt.Errorf("Wrong gravity, allowed values are %s.", gravityNames())
+		}
+		p.Gravity = g
+	}
+	if bg := params["background"]; bg != "" {
+		var err error
+		if p.Background, err = parseHexColor(bg); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Pastes img into square of background color at position given by gravity
+func putInSquare(img image.Image, size int, p *squareParams) *image.NRGBA {
+	dst := imaging.New(size, size, p.Background)
+	b := img.Bounds()
+	pt := image.Pt((size-b.Dx())*p.Gravity.x/2, (size-b.Dy())*p.Gravity.y/2)
+	return imaging.Overlay(dst, img, pt, 1)
+}
+
+// Makes square output of the given size, zero size means the largest
+// side of the source in fit mode and the smallest one in crop mode.
+// Images are never scaled up.
+type squareProcessor struct {
+	name string
+	size int
+}
+
+func (p *squareProcessor) Name() string {
+	return p.name
+}
+
+func (p *squareProcessor) Validate(params map[string]string) error {
+	_, err := parseSquareParams(params)
+	return err
+}
+
+func (p *squareProcessor) Deterministic() bool {
+	return true
+}
+
+func (p *squareProcessor) Process(src *Source, params map[string]string) ([]*Output, error) {
+	sp, err := parseSquareParams(params)
+	if err != nil {
+		return nil, err
+	}
+	b := src.Image.Bounds()
+	var res *image.NRGBA
+	if sp.Mode == SquareCrop {
+		side := b.Dx()
+		if b.Dy() < side {
+			side = b.Dy()
+		}
+		res = imaging.CropAnchor(src.Image, side, side, sp.Gravity.anchor)
+		if p.size > 0 && side > p.size {
+			res = imaging.Resize(res, p.size, p.size, imaging.Lanczos)
+		}
+		if p.size > side {
+			res = putInSquare(res, p.size, sp)
+		}
+	} else {
+		size := p.size
+		if size == 0 {
+			size = b.Dx()
+			if b.Dy() > size {
+				size = b.Dy()
+			}
+		}
+		res = putInSquare(imaging.Fit(src.Image, size, size, imaging.Lanczos), size, sp)
+	}
+	return []*Output{{Image: res, Kind: p.name}}, nil
+}
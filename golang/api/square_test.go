@@ -0,0 +1,92 @@
+package api
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	red   = color.NRGBA{255, 0, 0, 255}
+	white = color.NRGBA{255, 255, 255, 255}
+	blue  = color.NRGBA{0, 0, 255, 255}
+)
+
+func pixel(img image.Image, x, y int) color.NRGBA {
+	return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+}
+
+func TestSquareValidate(t *testing.T) {
+	proc, ok := LookupProcessor(JOB_SQUARE_SMALL)
+	require.True(t, ok)
+	assert.Nil(t, proc.Validate(map[string]string{}))
+	assert.Nil(t, proc.Validate(map[string]string{"square": "crop", "gravity": "topleft", "background": "00000000"}))
+	assert.NotNil(t, proc.Validate(map[string]string{"square": "dummy"}))
+	assert.NotNil(t, proc.Validate(map[string]string{"gravity": "dummy"}))
+	assert.NotNil(t, proc.Validate(map[string]string{"background": "fff"}))
+}
+
+func TestSquareFit(t *testing.T) {
+	src := &Source{Image: imaging.New(600, 300, red)}
+	proc, _ := LookupProcessor(JOB_SQUARE_SMALL)
+	outs, err := proc.Process(src, map[string]string{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(outs))
+	img := outs[0].Image
+	assert.Equal(t, image.Rect(0, 0, 256, 256), img.Bounds())
+	assert.Equal(t, JOB_SQUARE_SMALL, outs[0].Kind)
+	// scaled to 256x128 and centered on opaque white
+	assert.Equal(t, white, pixel(img, 128, 10))
+	assert.Equal(t, red, pixel(img, 128, 128))
+	assert.Equal(t, white, pixel(img, 128, 245))
+
+	outs, _ = proc.Process(src, map[string]string{"gravity": "bottom", "background": "0000ff"})
+	img = outs[0].Image
+	assert.Equal(t, blue, pixel(img, 128, 10))
+	assert.Equal(t, red, pixel(img, 128, 245))
+
+	// small images are not scaled up
+	outs, _ = proc.Process(&Source{Image: imaging.New(30, 20, red)}, map[string]string{})
+	img = outs[0].Image
+	assert.Equal(t, image.Rect(0, 0, 256, 256), img.Bounds())
+	assert.Equal(t, white, pixel(img, 100, 100))
+	assert.Equal(t, red, pixel(img, 128, 128))
+}
+
+func TestSquareOrig(t *testing.T) {
+	src := &Source{Image: imaging.New(30, 20, red)}
+	proc, _ := LookupProcessor(JOB_SQUARE_ORIG)
+	outs, err := proc.Process(src, map[string]string{})
+	require.Nil(t, err)
+	img := outs[0].Image
+	assert.Equal(t, image.Rect(0, 0, 30, 30), img.Bounds())
+	assert.Equal(t, white, pixel(img, 15, 2))
+	assert.Equal(t, red, pixel(img, 15, 15))
+
+	outs, _ = proc.Process(src, map[string]string{"gravity": "top"})
+	img = outs[0].Image
+	assert.Equal(t, red, pixel(img, 15, 2))
+	assert.Equal(t, white, pixel(img, 15, 27))
+}
+
+func TestSquareCrop(t *testing.T) {
+	// left half red, right half blue
+	src := imaging.New(600, 300, red)
+	src = imaging.Paste(src, imaging.New(300, 300, blue), image.Pt(300, 0))
+	proc, _ := LookupProcessor(JOB_SQUARE_ORIG)
+	outs, err := proc.Process(&Source{Image: src}, map[string]string{"square": "crop", "gravity": "left"})
+	require.Nil(t, err)
+	img := outs[0].Image
+	assert.Equal(t, image.Rect(0, 0, 300, 300), img.Bounds())
+	assert.Equal(t, red, pixel(img, 290, 150))
+
+	proc, _ = LookupProcessor(JOB_SQUARE_SMALL)
+	outs, _ = proc.Process(&Source{Image: src}, map[string]string{"square": "crop", "gravity": "right"})
+	img = outs[0].Image
+	assert.Equal(t, image.Rect(0, 0, 256, 256), img.Bounds())
+	assert.Equal(t, blue, pixel(img, 5, 128))
+}
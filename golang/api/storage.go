@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Stored object, key is relative to the storage root
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Place where image files live, keys are slash separated paths.
+// Methods return NotFoundError when object with the key does not exist.
+type Storage interface {
+	// Writes content of r under key replacing existing object, returns its size
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Removes object, missing object is not an error
+	Delete(ctx context.Context, key string) error
+	// Returns all objects with keys starting with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// Storage keeping objects as files under Root directory
+type LocalStorage struct {
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+// Returns file path of the key. Images saved before storages were
+// introduced keep absolute paths as keys, those are used as is.
+func (s *LocalStorage) path(key string) (string, error) {
+	if filepath.IsAbs(key) {
+		return key, nil
+	}
+	p := filepath.Clean(filepath.FromSlash(key))
+	if p == "." || p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Wrong storage key %s.", key)
+	}
+	return filepath.Join(s.Root, p), nil
+}
+
+// Returns key of the file path, it is the path itself if it is outside of Root
+func (s *LocalStorage) Key(path string) string {
+	if !filepath.IsAbs(path) {
+		return path
+	}
+	rel, err := filepath.Rel(s.Root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func notFoundKey(key string) error {
+	return NotFoundError{Msg: fmt.Sprintf("ObjectNotFound %s", key)}
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, err
+	}
+	// readers never see partially written file, the existing one is replaced at once
+	out, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), path)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *LocalStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, notFoundKey(key)
+	}
+	return file, err
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, notFoundKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		key := s.Key(path)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// Returns storage selected by DJAVUE_STORAGE environment variable,
+// local storage in mediaRoot is the default.
+func StorageFromEnv(mediaRoot string) (Storage, error) {
+	switch kind := os.Getenv("DJAVUE_STORAGE"); kind {
+	case "", StorageLocal:
+		return NewLocalStorage(mediaRoot), nil
+	case StorageS3:
+		cfg := S3Config{
+			Endpoint:  os.Getenv("DJAVUE_S3_ENDPOINT"),
+			Region:    os.Getenv("DJAVUE_S3_REGION"),
+			Bucket:    os.Getenv("DJAVUE_S3_BUCKET"),
+			AccessKey: os.Getenv("DJAVUE_S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("DJAVUE_S3_SECRET_KEY"),
+			Prefix:    os.Getenv("DJAVUE_S3_PREFIX"),
+		}
+		return NewS3Storage(cfg)
+	default:
+		return nil, fmt.Errorf("Unknown storage %s.", kind)
+	}
+}
@@ -1,9 +1,12 @@
 package api
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"sync"
 	"time"
 
 	ulid "github.com/oklog/ulid/v2"
@@ -20,11 +23,42 @@ func NewToken() (string, error) {
 	return hex.EncodeToString(b), nil
 }
 
+// Length of token part stored as is to find the token
+const TokenPrefixLen = 8
+
+func TokenPrefix(key string) string {
+	if len(key) < TokenPrefixLen {
+		return key
+	}
+	return key[:TokenPrefixLen]
+}
+
+// Keyed hash of a token, only it is stored in database
+func HashToken(secret []byte, key string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Compares hashes in constant time
+func TokenHashEqual(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
+
 func NewULIDNow() (string, error) {
 	return NewULID(time.Now())
 }
 
+// IDs made within the same millisecond keep the order they were made in,
+// listings and image kinds of composite jobs rely on it.
+var (
+	ulidMu      sync.Mutex
+	ulidEntropy = ulid.Monotonic(rand.Reader, 0)
+)
+
 func NewULID(tm time.Time) (string, error) {
-	id, err := ulid.New(ulid.Timestamp(tm), rand.Reader)
+	ulidMu.Lock()
+	defer ulidMu.Unlock()
+	id, err := ulid.New(ulid.Timestamp(tm), ulidEntropy)
 	return fmt.Sprintf("%s", id), err
 }
@@ -7,6 +7,23 @@ import (
 )
 
 func TestULIDGen(t *testing.T) {
-	_, err := NewULIDNow()
+	prev, err := NewULIDNow()
 	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		id, err := NewULIDNow()
+		assert.Nil(t, err)
+		assert.True(t, prev < id)
+		prev = id
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	key, err := NewToken()
+	assert.Nil(t, err)
+	assert.Equal(t, key[:TokenPrefixLen], TokenPrefix(key))
+	assert.Equal(t, "abc", TokenPrefix("abc"))
+	hash := HashToken([]byte("secret"), key)
+	assert.True(t, TokenHashEqual(hash, HashToken([]byte("secret"), key)))
+	assert.False(t, TokenHashEqual(hash, HashToken([]byte("other"), key)))
+	assert.False(t, TokenHashEqual(hash, HashToken([]byte("secret"), key+"x")))
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"golavue.dmitriko.com/api"
+)
+
+func main() {
+	del := flag.Bool("delete", false, "remove orphan files older than grace period")
+	grace := flag.Duration("grace", api.DefaultGCGrace, "keep orphan files modified within this period")
+	flag.Parse()
+	dbPath := os.Getenv("DJAVUE_DB_PATH")
+	if dbPath == "" {
+		log.Fatal("DJAVUE_DB_PATH is not set")
+	}
+	mediaRoot := os.Getenv("DJAVUE_MEDIA")
+	if mediaRoot == "" {
+		log.Fatal("DJAVUE_MEDIA is not set")
+	}
+	dbw, err := api.NewDBWorker(dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dbw.Close()
+	storage, err := api.StorageFromEnv(mediaRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := dbw.CollectGarbage(context.Background(), storage, api.GCOptions{Delete: *del, Grace: *grace})
+	if err != nil {
+		log.Fatal(err)
+	}
+	deleted := make(map[string]bool, len(report.Deleted))
+	for _, key := range report.Deleted {
+		deleted[key] = true
+	}
+	for _, key := range report.Orphans {
+		if deleted[key] {
+			fmt.Printf("removed  %s\n", key)
+		} else {
+			fmt.Printf("orphan   %s\n", key)
+		}
+	}
+	for _, img := range report.Missing {
+		fmt.Printf("missing  %s %s\n", img.ID, img.Path)
+	}
+	fmt.Printf("%d orphans, %d removed, %d missing\n", len(report.Orphans), len(report.Deleted), len(report.Missing))
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 
@@ -8,6 +11,8 @@ import (
 )
 
 func main() {
+	invites := flag.Int("invites", 0, "number of single-use invite codes to generate")
+	flag.Parse()
 	dbPath := os.Getenv("DJAVUE_DB_PATH")
 	if dbPath == "" {
 		log.Fatal("DJAVUE_DB_PATH is not set")
@@ -17,10 +22,24 @@ func main() {
 		log.Fatal(err)
 	}
 	if err := dbw.CreateTables(); err != nil {
-		//		log.Fatal(err)
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	if *invites > 0 {
+		for i := 0; i < *invites; i++ {
+			code, err := api.NewInviteCode()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := dbw.SaveNewInviteCode(ctx, code); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(code.Code)
+		}
+		return
 	}
 	user, _ := api.NewUser("foo", "f00baRRR")
-	if err := dbw.SaveNewUser(user); err != nil {
+	if err := dbw.SaveNewUser(ctx, user); err != nil {
 		log.Fatal(err)
 	}
 }
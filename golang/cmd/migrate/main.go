@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"golavue.dmitriko.com/api"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "list pending migrations without applying them")
+	status := flag.Bool("status", false, "show all migrations and when they were applied")
+	flag.Parse()
+	dbPath := os.Getenv("DJAVUE_DB_PATH")
+	if dbPath == "" {
+		log.Fatal("DJAVUE_DB_PATH is not set")
+	}
+	dbw, err := api.NewDBWorker(dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dbw.Close()
+	switch {
+	case *status:
+		states, err := dbw.MigrationStatus()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.Applied() {
+				applied = s.AppliedAt.Time.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-30s %s\n", s.Migration.Version, s.Migration.Name, applied)
+		}
+	case *dryRun:
+		pending, err := dbw.PendingMigrations()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range pending {
+			fmt.Printf("would apply %d %s\n", m.Version, m.Name)
+		}
+	default:
+		applied, err := dbw.Migrate()
+		for _, m := range applied {
+			fmt.Printf("applied %d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
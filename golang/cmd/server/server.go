@@ -1,14 +1,46 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
 	"golavue.dmitriko.com/api"
 )
 
+// Returns integer value of environment variable or def if it is not set
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s is not valid integer", name)
+	}
+	return i
+}
+
+// Returns duration from environment variable like "720h" or def if it is not set
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s is not valid duration", name)
+	}
+	return d
+}
+
 func main() {
 	staticRoot := os.Getenv("DJAVUE_STATIC")
 	if staticRoot == "" {
@@ -18,17 +50,88 @@ func main() {
 	if mediaRoot == "" {
 		log.Fatal("DJAVUE_MEIDA is not set")
 	}
+	tokenSecret := os.Getenv("DJAVUE_TOKEN_SECRET")
+	if tokenSecret == "" {
+		log.Fatal("DJAVUE_TOKEN_SECRET is not set")
+	}
 	dbPath := os.Getenv("DJAVUE_DB_PATH")
 	if dbPath == "" {
 		log.Fatal("DJAVUE_DB_PATH is not set")
 	}
-	dbw, err := api.NewDBWorker(dbPath)
+	dbConfig := api.DefaultDBConfig
+	dbConfig.BusyTimeout = time.Duration(envInt("DJAVUE_DB_BUSY_TIMEOUT",
+		int(dbConfig.BusyTimeout.Milliseconds()))) * time.Millisecond
+	dbConfig.MaxReaders = envInt("DJAVUE_DB_READERS", dbConfig.MaxReaders)
+	dbConfig.QueryTimeout = time.Duration(envInt("DJAVUE_DB_QUERY_TIMEOUT",
+		int(dbConfig.QueryTimeout.Milliseconds()))) * time.Millisecond
+	dbw, err := api.NewDBWorkerConfig(dbPath, dbConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if os.Getenv("DJAVUE_SKIP_MIGRATE") == "" {
+		applied, err := dbw.Migrate()
+		for _, m := range applied {
+			log.Printf("applied migration %d %s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	storage, err := api.StorageFromEnv(mediaRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := api.NewApp(dbw, mediaRoot)
+	app.Storage = storage
+	app.INVITE_CODE = os.Getenv("DJAVUE_INVITE_CODE")
+	app.TOKEN_TTL = envDuration("DJAVUE_TOKEN_TTL", api.DefaultTokenTTL)
+	app.TOKEN_SECRET = []byte(tokenSecret)
+	app.Queue = api.NewJobQueue(dbw, storage,
+		envInt("DJAVUE_WORKERS", api.DefaultWorkers),
+		envInt("DJAVUE_QUEUE_SIZE", api.DefaultQueueSize))
+	app.INSTANCE = os.Getenv("DJAVUE_INSTANCE")
+	requeued, failed, err := app.Queue.Recover(context.Background(), app.INSTANCE, mediaRoot)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if requeued > 0 || failed > 0 {
+		log.Printf("recovered unfinished jobs: %d queued again, %d failed", requeued, failed)
+	}
+	app.MAX_BODY_SIZE = int64(envInt("DJAVUE_MAX_BODY_SIZE", api.DefaultMaxBodySize))
+	app.MAX_FILE_SIZE = int64(envInt("DJAVUE_MAX_FILE_SIZE", api.DefaultMaxFileSize))
+	app.MAX_PIXELS = int64(envInt("DJAVUE_MAX_PIXELS", api.DefaultMaxPixels))
+	app.MAX_BATCH_BODY_SIZE = int64(envInt("DJAVUE_MAX_BATCH_BODY_SIZE", api.DefaultMaxBatchBodySize))
+	app.MAX_BATCH_FILES = envInt("DJAVUE_MAX_BATCH_FILES", api.DefaultMaxBatchFiles)
+	if interval := envDuration("DJAVUE_GC_INTERVAL", 0); interval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go dbw.RunGC(ctx, storage, interval, api.GCOptions{
+			Delete: os.Getenv("DJAVUE_GC_DELETE") != "",
+			Grace:  envDuration("DJAVUE_GC_GRACE", api.DefaultGCGrace),
+		})
+	}
 
 	r := gin.Default()
-	router := api.SetupRouter(r, dbw, mediaRoot)
+	router := app.SetupRouter(r)
 	router.Use(static.Serve("/", static.LocalFile(staticRoot, false)))
-	router.Run(":8080")
+	srv := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Print("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("DJAVUE_SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("could not shut down server: %s", err.Error())
+	}
+	// jobs already accepted are performed before exit
+	app.Queue.Stop()
 }